@@ -0,0 +1,277 @@
+//=================================================================================
+//	Filaname: audio.go
+// 	Function: playback and recording of received opus audio in sync with video
+// 	Author: Stoney Kang, sikang@teamgrit.kr
+// 	Copyright: TeamGRIT, 2021
+//=================================================================================
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v2"
+	"github.com/pion/webrtc/v2/pkg/media/oggwriter"
+)
+
+//---------------------------------------------------------------------------------
+const (
+	opusSampleRate   = 48000
+	opusChannelCount = 2
+	videoClockRate   = 90000
+)
+
+// AudioSink consumes the received opus packets
+type AudioSink interface {
+	WriteRTP(pkt *rtp.Packet) error
+	Close() error
+}
+
+// oggSink writes opus packets into an ogg file
+type oggSink struct {
+	writer *oggwriter.OggWriter
+}
+
+// playerSink plays opus packets through ffmpeg to a local audio device
+type playerSink struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	writer *oggwriter.OggWriter
+}
+
+//---------------------------------------------------------------------------------
+// NewAudioSink opens a sink by output name: pulse, alsa or a path of .ogg/.opus file
+func NewAudioSink(output string) (sink AudioSink, err error) {
+	log.Println("i.NewAudioSink:", output)
+
+	// not to return a typed nil in the interface on errors
+	switch output {
+	case "pulse", "alsa":
+		s, err := newPlayerSink(output)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+	switch strings.ToLower(filepath.Ext(output)) {
+	case ".ogg", ".opus":
+		s, err := newOggSink(output)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+	err = fmt.Errorf("unknown audio output: %s", output)
+	return
+}
+
+func newOggSink(name string) (s *oggSink, err error) {
+	w, err := oggwriter.New(name, opusSampleRate, opusChannelCount)
+	if err != nil {
+		return nil, err
+	}
+	return &oggSink{writer: w}, nil
+}
+
+func (s *oggSink) WriteRTP(pkt *rtp.Packet) error {
+	return s.writer.WriteRTP(pkt)
+}
+
+func (s *oggSink) Close() error {
+	return s.writer.Close()
+}
+
+func newPlayerSink(device string) (s *playerSink, err error) {
+	cmd := exec.Command("ffmpeg", "-hide_banner", "-loglevel", "error",
+		"-f", "ogg", "-i", "pipe:0", "-f", device, "default")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		stdin.Close()
+		return nil, err
+	}
+	err = cmd.Start()
+	if err != nil {
+		stdin.Close()
+		return nil, err
+	}
+
+	go func() {
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			log.Println("[audio]", scanner.Text())
+		}
+	}()
+
+	writer, err := oggwriter.NewWith(stdin, opusSampleRate, opusChannelCount)
+	if err != nil {
+		stdin.Close()
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, err
+	}
+	return &playerSink{cmd: cmd, stdin: stdin, writer: writer}, nil
+}
+
+func (s *playerSink) WriteRTP(pkt *rtp.Packet) error {
+	return s.writer.WriteRTP(pkt)
+}
+
+func (s *playerSink) Close() (err error) {
+	s.writer.Close() // closes stdin too
+	return s.cmd.Wait()
+}
+
+//---------------------------------------------------------------------------------
+// mediaClock maps rtp timestamps of each track to local capture time. Sender
+// reports align the tracks, otherwise the arrival of the first packet is used.
+type mediaClock struct {
+	sync.Mutex
+	refs    map[uint32]clockRef
+	offset  time.Duration // local time - sender ntp time
+	synced  bool
+	video   time.Time // capture time of the last video packet sent to the decoder
+	videoAt time.Time // local time when video was set, to tell a stalled video
+}
+
+type clockRef struct {
+	time time.Time
+	ts   uint32
+}
+
+func newMediaClock() *mediaClock {
+	return &mediaClock{refs: map[uint32]clockRef{}}
+}
+
+// updateSenderReport maps the rtp time of a track to the sender's wall clock
+func (c *mediaClock) updateSenderReport(sr *rtcp.SenderReport) {
+	c.Lock()
+	defer c.Unlock()
+
+	ntp := ntpToTime(sr.NTPTime)
+	if !c.synced {
+		c.offset = time.Since(ntp)
+		c.synced = true
+	}
+	c.refs[sr.SSRC] = clockRef{time: ntp.Add(c.offset), ts: sr.RTPTime}
+}
+
+// captureTime returns the local capture time of a packet
+func (c *mediaClock) captureTime(ssrc, ts, rate uint32) time.Time {
+	c.Lock()
+	defer c.Unlock()
+
+	ref, ok := c.refs[ssrc]
+	if !ok {
+		ref = clockRef{time: time.Now(), ts: ts}
+		c.refs[ssrc] = ref
+	}
+	diff := int64(int32(ts - ref.ts))
+	return ref.time.Add(time.Duration(diff * int64(time.Second) / int64(rate)))
+}
+
+func (c *mediaClock) setVideo(t time.Time) {
+	c.Lock()
+	defer c.Unlock()
+	c.video = t
+	c.videoAt = time.Now()
+}
+
+// waitVideo holds until the video has reached t, up to max. It does not wait
+// for a video not advanced for max, ex. by loss or decoder restart, so that
+// the wait is bounded in total, not per packet.
+func (c *mediaClock) waitVideo(t time.Time, max time.Duration, done chan struct{}) {
+	deadline := time.Now().Add(max)
+	for time.Now().Before(deadline) {
+		c.Lock()
+		video, videoAt := c.video, c.videoAt
+		c.Unlock()
+		if video.IsZero() || !video.Before(t) || time.Since(videoAt) > max {
+			return
+		}
+		select {
+		case <-done:
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func (c *mediaClock) reset() {
+	c.Lock()
+	defer c.Unlock()
+	c.refs = map[uint32]clockRef{}
+	c.synced = false
+	c.video, c.videoAt = time.Time{}, time.Time{}
+}
+
+// ntpToTime converts a 64 bits ntp timestamp into time
+func ntpToTime(ntp uint64) time.Time {
+	const ntpEpochOffset = 2208988800 // seconds from 1900 to 1970
+	sec := int64(ntp>>32) - ntpEpochOffset
+	nsec := int64((ntp & 0xFFFFFFFF) * uint64(time.Second) >> 32)
+	return time.Unix(sec, nsec)
+}
+
+//---------------------------------------------------------------------------------
+// readSenderReports feeds the sender reports of a track into the media clock
+func (d *Program) readSenderReports(receiver *webrtc.RTPReceiver, fb *feedback) {
+	for !d.quitting() {
+		pkts, err := receiver.ReadRTCP()
+		if err != nil {
+			return
+		}
+		for _, pkt := range pkts {
+			if sr, ok := pkt.(*rtcp.SenderReport); ok {
+				d.clock.updateSenderReport(sr)
+				fb.senderReport(sr)
+			}
+		}
+	}
+}
+
+// receiveAudio sends opus packets to the audio sink paced by the video
+func (d *Program) receiveAudio(track *webrtc.Track, fb *feedback, done chan struct{}) {
+	log.Println("i.receiveAudio:", track.ID(), track.Codec().MimeType)
+
+	if d.audio == nil {
+		log.Println("ignore>", track.Kind(), "track:", track.ID())
+		return
+	}
+
+	maxWait := time.Duration(d.AudioSyncMax) * time.Millisecond
+	for !d.quitting() {
+		pkt, err := track.ReadRTP()
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		d.astats.add(pkt, opusSampleRate)
+		fb.received(pkt, false)
+
+		if maxWait > 0 {
+			t := d.clock.captureTime(pkt.SSRC, pkt.Timestamp, opusSampleRate)
+			d.clock.waitVideo(t, maxWait, done)
+		}
+
+		err = d.audio.WriteRTP(pkt)
+		if err != nil {
+			log.Println("audio:", err)
+			return
+		}
+	}
+}
+
+//=================================================================================
@@ -0,0 +1,99 @@
+//=================================================================================
+//	Filaname: auth.go
+// 	Function: authentication to subscribe a channel of spider server
+// 	Author: Stoney Kang, sikang@teamgrit.kr
+// 	Copyright: TeamGRIT, 2021
+//=================================================================================
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//---------------------------------------------------------------------------------
+// AuthError is returned when the spider server rejects the subscription
+type AuthError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *AuthError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("subscription rejected: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("subscription rejected: %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+//---------------------------------------------------------------------------------
+// authHeader returns the header of the handshake with a bearer token or basic auth.
+// The token file is read at every connection to use a refreshed token.
+func (d *Program) authHeader() (header http.Header, err error) {
+	header = http.Header{}
+
+	token := d.AuthToken
+	if d.AuthTokenFile != "" {
+		data, err := os.ReadFile(d.AuthTokenFile)
+		if err != nil {
+			return nil, err
+		}
+		token = strings.TrimSpace(string(data))
+	}
+
+	switch {
+	case token != "":
+		header.Set("Authorization", "Bearer "+token)
+	case d.AuthUser != "":
+		req := http.Request{Header: header}
+		req.SetBasicAuth(d.AuthUser, d.AuthPass)
+	}
+	return
+}
+
+// signURL adds expires and signature to the query of the url. The signature is
+// base64url HMAC-SHA256 of the path and query including expires, by the shared secret.
+func (d *Program) signURL(rawurl string) (signed string, err error) {
+	if d.SignSecret == "" {
+		return rawurl, nil
+	}
+
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return
+	}
+	q := u.Query()
+	q.Del("signature")
+	q.Set("expires", strconv.FormatInt(time.Now().Add(time.Duration(d.SignTTL)*time.Second).Unix(), 10))
+	u.RawQuery = q.Encode()
+
+	mac := hmac.New(sha256.New, []byte(d.SignSecret))
+	mac.Write([]byte(u.RequestURI()))
+	q.Set("signature", base64.RawURLEncoding.EncodeToString(mac.Sum(nil)))
+	u.RawQuery = q.Encode()
+
+	signed = u.String()
+	return
+}
+
+// authError returns AuthError if the handshake is rejected by the server
+func authError(resp *http.Response) error {
+	if resp == nil || (resp.StatusCode != http.StatusUnauthorized && resp.StatusCode != http.StatusForbidden) {
+		return nil
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return &AuthError{
+		StatusCode: resp.StatusCode,
+		Message:    strings.TrimSpace(string(body)),
+	}
+}
+
+//=================================================================================
@@ -0,0 +1,112 @@
+//=================================================================================
+//	Filaname: auth_test.go
+// 	Function: tests of authentication to subscribe a channel
+// 	Author: Stoney Kang, sikang@teamgrit.kr
+// 	Copyright: TeamGRIT, 2021
+//=================================================================================
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+//---------------------------------------------------------------------------------
+func TestAuthHeader(t *testing.T) {
+	dir := t.TempDir()
+	tokenFile := filepath.Join(dir, "token")
+	if err := os.WriteFile(tokenFile, []byte(" refreshed\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		d    *Program
+		auth string
+		ok   bool
+	}{
+		{"none", &Program{}, "", true},
+		{"token", &Program{AuthToken: "abc"}, "Bearer abc", true},
+		{"token file", &Program{AuthToken: "abc", AuthTokenFile: tokenFile}, "Bearer refreshed", true},
+		{"basic", &Program{AuthUser: "alice", AuthPass: "pw"}, "Basic YWxpY2U6cHc=", true},
+		{"token over basic", &Program{AuthToken: "abc", AuthUser: "alice"}, "Bearer abc", true},
+		{"no token file", &Program{AuthTokenFile: filepath.Join(dir, "none")}, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header, err := tt.d.authHeader()
+			if (err == nil) != tt.ok {
+				t.Fatalf("authHeader = %v, want ok %v", err, tt.ok)
+			}
+			if auth := header.Get("Authorization"); auth != tt.auth {
+				t.Errorf("Authorization = %q, want %q", auth, tt.auth)
+			}
+		})
+	}
+}
+
+func TestSignURL(t *testing.T) {
+	tests := []struct {
+		name   string
+		secret string
+		url    string
+		query  url.Values // of the signed url, without expires and signature
+	}{
+		{"no secret", "", "wss://spider/live/ws/sub?channel=cam1", nil},
+		{"query", "secret", "wss://spider/live/ws/sub?channel=cam1&vcodec=h264",
+			url.Values{"channel": {"cam1"}, "vcodec": {"h264"}}},
+		{"old signature", "secret", "https://host/whep/cam1?signature=old&expires=1",
+			url.Values{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &Program{SignSecret: tt.secret, SignTTL: 60}
+			expiry := time.Now().Add(time.Minute).Unix()
+			signed, err := d.signURL(tt.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.secret == "" {
+				if signed != tt.url {
+					t.Errorf("signURL = %s, want %s", signed, tt.url)
+				}
+				return
+			}
+
+			u, err := url.Parse(signed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			q := u.Query()
+			at, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+			if err != nil || at < expiry || at > expiry+1 {
+				t.Errorf("expires %s, want %d", q.Get("expires"), expiry)
+			}
+
+			signature := q.Get("signature")
+			q.Del("signature")
+			u.RawQuery = q.Encode()
+			mac := hmac.New(sha256.New, []byte(tt.secret))
+			mac.Write([]byte(u.RequestURI()))
+			if want := base64.RawURLEncoding.EncodeToString(mac.Sum(nil)); signature != want {
+				t.Errorf("signature %s, want %s", signature, want)
+			}
+
+			q.Del("expires")
+			if q.Encode() != tt.query.Encode() {
+				t.Errorf("query %s, want %s", q.Encode(), tt.query.Encode())
+			}
+		})
+	}
+}
+
+//=================================================================================
@@ -0,0 +1,282 @@
+//=================================================================================
+//	Filaname: clip.go
+// 	Function: event clips of motion with the video before it
+// 	Author: Stoney Kang, sikang@teamgrit.kr
+// 	Copyright: TeamGRIT, 2021
+//=================================================================================
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+//---------------------------------------------------------------------------------
+const (
+	clipMaxPackets = 20_000 // limit of the pre-roll buffer when key frames are rare
+	clipQueueSize  = 4096   // packets queued to the writer of a clip
+)
+
+// ClipInfo is the metadata of a clip, written next to it in json
+type ClipInfo struct {
+	Channel string    `json:"channel"`
+	File    string    `json:"file"`
+	Start   time.Time `json:"start"`  // time of the first frame, pre-roll included
+	Motion  time.Time `json:"motion"` // time when motion started
+	End     time.Time `json:"end"`
+	MaxArea float64   `json:"max_area"` // max area of motion in a frame
+	Bytes   int64     `json:"bytes"`
+}
+
+// ClipRecorder keeps the last packets of the stream in a ring buffer, and when
+// motion starts, writes them and the live stream to a clip until motion is absent
+// for the hold time. A clip starts at a key frame, and is written by its own
+// goroutine not to block the reading of the stream.
+type ClipRecorder struct {
+	Dir     string
+	Channel string
+	Codec   string              // video codec of the stream, h264, vp8, vp9 or av1
+	Format  string              // mp4 (fragmented) or mkv
+	PreRoll time.Duration       // video kept before motion
+	Hold    time.Duration       // time without motion to end a clip
+	Saved   func(info ClipInfo) // called when a clip is closed
+
+	mu   sync.Mutex
+	ring []clipPacket
+	keys []int     // positions of the key frames in the ring
+	last time.Time // time of the last motion
+	clip *clip     // clip of the current motion
+	wg   sync.WaitGroup
+}
+
+type clipPacket struct {
+	pkt *rtp.Packet
+	key bool
+	at  time.Time
+}
+
+// clip is a clip being written, waiting for a key frame until packets is made
+type clip struct {
+	info    ClipInfo // owned by the writer after packets is closed
+	packets chan *rtp.Packet
+}
+
+//---------------------------------------------------------------------------------
+func NewClipRecorder(dir, channel, codec, format string, preRoll, hold time.Duration) (c *ClipRecorder, err error) {
+	log.Println("i.NewClipRecorder:", dir, channel, codec, format, preRoll, hold)
+
+	err = checkRecordFormat(codec, format)
+	if err != nil {
+		return
+	}
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return
+	}
+
+	c = &ClipRecorder{
+		Dir:     dir,
+		Channel: channel,
+		Codec:   codec,
+		Format:  format,
+		PreRoll: preRoll,
+		Hold:    hold,
+	}
+	return
+}
+
+// WriteRTP queues a packet to the clip if motion, and keeps it for the pre-roll
+func (c *ClipRecorder) WriteRTP(pkt *rtp.Packet) (err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := isKeyFrame(c.Codec, pkt.Payload)
+	if c.clip != nil && c.clip.packets == nil && key {
+		c.openClip()
+	}
+	if c.clip != nil && c.clip.packets != nil {
+		select {
+		case c.clip.packets <- pkt:
+		default:
+			return fmt.Errorf("clip %s: packet dropped, writer too slow", c.clip.info.File)
+		}
+		return
+	}
+
+	if key {
+		c.keys = append(c.keys, len(c.ring))
+	}
+	c.ring = append(c.ring, clipPacket{pkt: pkt, key: key, at: time.Now()})
+	c.trimRing()
+	return
+}
+
+// Motion starts a clip at motion, and ends it after the hold time without motion
+func (c *ClipRecorder) Motion(res MotionResult) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if res.Detected {
+		c.last = res.Time
+		if c.clip == nil {
+			c.startClip(res.Time)
+		}
+		if res.Area > c.clip.info.MaxArea {
+			c.clip.info.MaxArea = res.Area
+		}
+		return
+	}
+	if c.clip != nil && res.Time.Sub(c.last) >= c.Hold {
+		c.closeClip()
+	}
+}
+
+// Restart ends the clip and drops the pre-roll, for a new stream of the track
+func (c *ClipRecorder) Restart() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closeClip()
+	c.ring, c.keys = nil, nil
+}
+
+// SetChannel names the next clips by the channel, switched by the control api
+func (c *ClipRecorder) SetChannel(channel string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Channel = channel
+}
+
+// Close ends the clip and waits for the clips being written
+func (c *ClipRecorder) Close() (err error) {
+	c.mu.Lock()
+	c.closeClip()
+	c.mu.Unlock()
+	c.wg.Wait()
+	return
+}
+
+//---------------------------------------------------------------------------------
+// trimRing drops the packets older than the pre-roll, but keeps the ring starting
+// at a key frame, the latest one before the pre-roll. It looks only at the key
+// frames, and moves the ring only when one of them is dropped.
+func (c *ClipRecorder) trimRing() {
+	cutoff := time.Now().Add(-c.PreRoll)
+	drop := 0
+	for drop+1 < len(c.keys) && !c.ring[c.keys[drop+1]].at.After(cutoff) {
+		drop++
+	}
+	for drop < len(c.keys) && len(c.ring)-c.keys[drop] > clipMaxPackets {
+		drop++
+	}
+
+	start := len(c.ring) // nothing to start with
+	if drop < len(c.keys) {
+		start = c.keys[drop]
+	}
+	if start == 0 {
+		return
+	}
+	c.ring = append(c.ring[:0], c.ring[start:]...)
+	keys := c.keys[:0]
+	for _, k := range c.keys[drop:] {
+		keys = append(keys, k-start)
+	}
+	c.keys = keys
+}
+
+// startClip opens a clip with the pre-roll, or waits for a key frame if none
+func (c *ClipRecorder) startClip(motion time.Time) {
+	c.clip = &clip{info: ClipInfo{Channel: c.Channel, Motion: motion}}
+	if len(c.ring) == 0 {
+		log.Println("clip waits for a key frame")
+		return
+	}
+	c.openClip()
+}
+
+// openClip hands the pre-roll to a new writer of the clip
+func (c *ClipRecorder) openClip() {
+	cl := c.clip
+	cl.info.Start = time.Now()
+	if len(c.ring) > 0 {
+		cl.info.Start = c.ring[0].at
+	}
+	cl.info.File = filepath.Join(c.Dir, fmt.Sprintf("%s_%s.%s",
+		cl.info.Channel, cl.info.Motion.Format(recordTime), c.Format))
+	log.Println("i.openClip:", cl.info.File, "pre-roll:", len(c.ring), "packets")
+
+	cl.packets = make(chan *rtp.Packet, clipQueueSize)
+	c.wg.Add(1)
+	go c.writeClip(cl, c.ring)
+	c.ring, c.keys = nil, nil
+}
+
+// closeClip ends the clip, written by its writer, or drops it if not yet started
+func (c *ClipRecorder) closeClip() {
+	cl := c.clip
+	c.clip = nil
+	if cl == nil || cl.packets == nil {
+		return
+	}
+	cl.info.End = time.Now()
+	close(cl.packets)
+}
+
+// writeClip writes the pre-roll and the queued packets to ffmpeg, timed by
+// the rtp timestamps, and the metadata when the packets are closed
+func (c *ClipRecorder) writeClip(cl *clip, preRoll []clipPacket) {
+	defer c.wg.Done()
+
+	var written int64
+	cmd, stdin, writer, err := startRemux(c.Codec, c.Format, cl.info.File, true, &written)
+	if err != nil {
+		log.Println(err)
+		for range cl.packets {
+		}
+		return
+	}
+	for _, p := range preRoll {
+		if err == nil {
+			err = writer.WriteRTP(p.pkt)
+		}
+	}
+	for pkt := range cl.packets {
+		if err == nil {
+			err = writer.WriteRTP(pkt)
+		}
+	}
+	if err != nil {
+		log.Println(err)
+	}
+
+	stdin.Close()
+	err = cmd.Wait()
+	if err != nil {
+		log.Println(err)
+	}
+	log.Println("i.writeClip:", cl.info.File, written, "bytes")
+
+	cl.info.Bytes = written
+	data, err := json.MarshalIndent(cl.info, "", "  ")
+	if err != nil {
+		return
+	}
+	name := strings.TrimSuffix(cl.info.File, filepath.Ext(cl.info.File)) + ".json"
+	err = os.WriteFile(name, data, 0644)
+	if err != nil {
+		log.Println(err)
+	}
+	if c.Saved != nil {
+		c.Saved(cl.info)
+	}
+}
+
+//=================================================================================
@@ -0,0 +1,71 @@
+//=================================================================================
+//	Filaname: clip_test.go
+// 	Function: tests of the pre-roll of motion clips
+// 	Author: Stoney Kang, sikang@teamgrit.kr
+// 	Copyright: TeamGRIT, 2021
+//=================================================================================
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+//---------------------------------------------------------------------------------
+func TestTrimRing(t *testing.T) {
+	tests := []struct {
+		name string
+		ages []int // age of the packets in seconds, the key frames negative
+		left int   // packets left in the ring
+		keys []int
+	}{
+		{"empty", nil, 0, nil},
+		{"no key frame", []int{3, 2, 1}, 0, nil},
+		{"within pre-roll", []int{-4, 3, -2, 1}, 4, []int{0, 2}},
+		{"key before pre-roll", []int{-9, 8, -7, 6, -3, 2}, 4, []int{0, 2}},
+		{"only keys before pre-roll", []int{-9, 8, -7, 6}, 2, []int{0}},
+		{"leading non key", []int{9, 8, -3, 2}, 2, []int{0}},
+	}
+
+	now := time.Now()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &ClipRecorder{PreRoll: 5 * time.Second}
+			for i, age := range tt.ages {
+				key := age < 0
+				if key {
+					age = -age
+					c.keys = append(c.keys, i)
+				}
+				c.ring = append(c.ring, clipPacket{key: key, at: now.Add(-time.Duration(age) * time.Second)})
+			}
+			c.trimRing()
+
+			if len(c.ring) != tt.left || !reflect.DeepEqual(c.keys, tt.keys) {
+				t.Errorf("ring %d keys %v, want %d keys %v", len(c.ring), c.keys, tt.left, tt.keys)
+			}
+			if len(c.ring) > 0 && !c.ring[0].key {
+				t.Errorf("ring starts at a non key frame")
+			}
+		})
+	}
+}
+
+func TestTrimRingMaxPackets(t *testing.T) {
+	c := &ClipRecorder{PreRoll: time.Hour}
+	now := time.Now()
+	for i := 0; i < clipMaxPackets+10; i++ {
+		key := i%1000 == 0
+		if key {
+			c.keys = append(c.keys, len(c.ring))
+		}
+		c.ring = append(c.ring, clipPacket{key: key, at: now})
+		c.trimRing()
+	}
+	if want := clipMaxPackets + 10 - 1000; len(c.ring) != want || c.keys[0] != 0 {
+		t.Errorf("ring %d keys from %d, want %d from 0", len(c.ring), c.keys[0], want)
+	}
+}
+
+//=================================================================================
@@ -0,0 +1,337 @@
+//=================================================================================
+//	Filaname: codec.go
+// 	Function: video codecs and their container writers for ffmpeg
+// 	Author: Stoney Kang, sikang@teamgrit.kr
+// 	Copyright: TeamGRIT, 2021
+//=================================================================================
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v2"
+	"github.com/pion/webrtc/v2/pkg/media/h264writer"
+)
+
+//---------------------------------------------------------------------------------
+const (
+	AV1                   = "AV1"
+	DefaultPayloadTypeAV1 = 41
+)
+
+// RTPWriter takes RTP packets of a track and writes them into a container
+type RTPWriter interface {
+	WriteRTP(pkt *rtp.Packet) error
+}
+
+// videoCodec describes how a video codec is negotiated and fed to ffmpeg
+type videoCodec struct {
+	name   string // name in sdp
+	fourcc string // fourcc in ivf, empty for annex-b
+	format string // input format of ffmpeg
+}
+
+var videoCodecs = map[string]videoCodec{
+	"h264": {name: webrtc.H264, format: "h264"},
+	"vp8":  {name: webrtc.VP8, fourcc: "VP80", format: "ivf"},
+	"vp9":  {name: webrtc.VP9, fourcc: "VP90", format: "ivf"},
+	"av1":  {name: AV1, fourcc: "AV01", format: "ivf"},
+}
+
+//---------------------------------------------------------------------------------
+// lookupVideoCodec finds a codec by its flag name (h264) or mime type (video/H264)
+func lookupVideoCodec(name string) (vc videoCodec, err error) {
+	name = strings.ToLower(strings.TrimPrefix(strings.ToLower(name), "video/"))
+	vc, ok := videoCodecs[name]
+	if !ok {
+		err = fmt.Errorf("unsupported video codec: %s", name)
+	}
+	return
+}
+
+// registerCodecs registers the default audio codecs and only the given video codec,
+// so the spider server and ffmpeg always agree on the video stream
+func registerCodecs(me *webrtc.MediaEngine, vcodec string) (err error) {
+	vc, err := lookupVideoCodec(vcodec)
+	if err != nil {
+		return
+	}
+
+	me.RegisterCodec(webrtc.NewRTPOpusCodec(webrtc.DefaultPayloadTypeOpus, opusSampleRate))
+	me.RegisterCodec(webrtc.NewRTPPCMUCodec(webrtc.DefaultPayloadTypePCMU, 8000))
+	me.RegisterCodec(webrtc.NewRTPPCMACodec(webrtc.DefaultPayloadTypePCMA, 8000))
+	me.RegisterCodec(webrtc.NewRTPG722Codec(webrtc.DefaultPayloadTypeG722, 8000))
+
+	var c *webrtc.RTPCodec
+	switch vc.name {
+	case webrtc.H264:
+		c = webrtc.NewRTPH264Codec(webrtc.DefaultPayloadTypeH264, videoClockRate)
+	case webrtc.VP8:
+		c = webrtc.NewRTPVP8Codec(webrtc.DefaultPayloadTypeVP8, videoClockRate)
+	case webrtc.VP9:
+		c = webrtc.NewRTPVP9Codec(webrtc.DefaultPayloadTypeVP9, videoClockRate)
+	case AV1:
+		// receive only, so no payloader is needed
+		c = webrtc.NewRTPCodec(webrtc.RTPCodecTypeVideo, AV1, videoClockRate,
+			0, "", DefaultPayloadTypeAV1, nil)
+	}
+	// nack, pli and remb sent by feedback
+	c.RTCPFeedback = videoFeedback
+	me.RegisterCodec(c)
+	return
+}
+
+// newVideoWriter returns the container writer for a track of the mime type
+func newVideoWriter(mime string, w io.Writer, width, height int) (writer RTPWriter, err error) {
+	vc, err := lookupVideoCodec(mime)
+	if err != nil {
+		return
+	}
+	if vc.fourcc == "" {
+		writer = h264writer.NewWith(w)
+		return
+	}
+	return NewIVFWriter(w, vc.fourcc, width, height)
+}
+
+// isKeyFrame reports whether the packet starts a key frame of the codec
+func isKeyFrame(mime string, payload []byte) bool {
+	vc, err := lookupVideoCodec(mime)
+	if err != nil || len(payload) == 0 {
+		return false
+	}
+
+	switch vc.name {
+	case webrtc.H264:
+		return isH264KeyFrame(payload)
+	case webrtc.VP8:
+		p := codecs.VP8Packet{}
+		if _, err := p.Unmarshal(payload); err != nil || len(p.Payload) == 0 {
+			return false
+		}
+		return p.S == 1 && p.PID == 0 && p.Payload[0]&0x01 == 0
+	case webrtc.VP9:
+		p := codecs.VP9Packet{}
+		if _, err := p.Unmarshal(payload); err != nil {
+			return false
+		}
+		return p.B && !p.P
+	case AV1:
+		return payload[0]&av1FlagN != 0
+	}
+	return false
+}
+
+// isH264KeyFrame reports a STAP-A packet starting with SPS, the same key frame
+// the h264writer waits for before writing anything
+func isH264KeyFrame(payload []byte) bool {
+	const typeSTAPA = 24
+	const typeSPS = 7
+
+	if len(payload) < 4 || payload[0]&0x1F != typeSTAPA {
+		return false
+	}
+	return payload[3]&0x1F == typeSPS
+}
+
+//---------------------------------------------------------------------------------
+// ivfH264 is the fourcc of H.264 in ivf, in annex-b, to keep the rtp timestamps
+const ivfH264 = "H264"
+
+// IVFWriter writes VP8, VP9, AV1 and H.264 frames into an IVF stream,
+// starting at the first key frame
+type IVFWriter struct {
+	w            io.Writer
+	fourcc       string
+	count        uint64
+	hasKeyFrame  bool
+	currentFrame []byte
+	obu          []byte // AV1 OBU fragmented over packets
+}
+
+func NewIVFWriter(w io.Writer, fourcc string, width, height int) (i *IVFWriter, err error) {
+	i = &IVFWriter{w: w, fourcc: fourcc}
+
+	header := make([]byte, 32)
+	copy(header[0:], "DKIF")
+	binary.LittleEndian.PutUint16(header[4:], 0)               // version
+	binary.LittleEndian.PutUint16(header[6:], 32)              // header size
+	copy(header[8:], fourcc)                                   // fourcc
+	binary.LittleEndian.PutUint16(header[12:], uint16(width))  // width in pixels
+	binary.LittleEndian.PutUint16(header[14:], uint16(height)) // height in pixels
+	binary.LittleEndian.PutUint32(header[16:], videoClockRate) // timebase denominator
+	binary.LittleEndian.PutUint32(header[20:], 1)              // timebase numerator
+	binary.LittleEndian.PutUint32(header[24:], 0)              // frame count, unknown
+	binary.LittleEndian.PutUint32(header[28:], 0)              // unused
+
+	_, err = w.Write(header)
+	return
+}
+
+// WriteRTP depacketizes a packet and writes a frame at the marker bit
+func (i *IVFWriter) WriteRTP(pkt *rtp.Packet) (err error) {
+	if len(pkt.Payload) == 0 {
+		return
+	}
+	if !i.hasKeyFrame {
+		if i.hasKeyFrame = isKeyFrame("video/"+i.codecName(), pkt.Payload); !i.hasKeyFrame {
+			return // key frame not yet, discarding packet
+		}
+	}
+
+	switch i.fourcc {
+	case "VP80":
+		p := codecs.VP8Packet{}
+		if _, err = p.Unmarshal(pkt.Payload); err != nil {
+			return
+		}
+		i.currentFrame = append(i.currentFrame, p.Payload...)
+	case "VP90":
+		p := codecs.VP9Packet{}
+		if _, err = p.Unmarshal(pkt.Payload); err != nil {
+			return
+		}
+		i.currentFrame = append(i.currentFrame, p.Payload...)
+	case "AV01":
+		err = i.depacketizeAV1(pkt.Payload)
+		if err != nil {
+			return
+		}
+	case ivfH264:
+		p := codecs.H264Packet{}
+		var nalus []byte
+		if nalus, err = p.Unmarshal(pkt.Payload); err != nil {
+			return
+		}
+		i.currentFrame = append(i.currentFrame, nalus...)
+	}
+
+	if !pkt.Marker || len(i.currentFrame) == 0 {
+		return
+	}
+
+	frameHeader := make([]byte, 12)
+	binary.LittleEndian.PutUint32(frameHeader[0:], uint32(len(i.currentFrame))) // frame length
+	binary.LittleEndian.PutUint64(frameHeader[4:], uint64(pkt.Timestamp))       // pts in 90kHz
+	i.count++
+
+	if _, err = i.w.Write(frameHeader); err != nil {
+		return
+	}
+	_, err = i.w.Write(i.currentFrame)
+	i.currentFrame = nil
+	return
+}
+
+func (i *IVFWriter) codecName() string {
+	if i.fourcc == ivfH264 {
+		return webrtc.H264
+	}
+	for _, vc := range videoCodecs {
+		if vc.fourcc == i.fourcc {
+			return vc.name
+		}
+	}
+	return ""
+}
+
+//---------------------------------------------------------------------------------
+// AV1 aggregation header, https://aomediacodec.github.io/av1-rtp-spec/
+const (
+	av1FlagZ = 0x80 // first OBU element continues the last one of the previous packet
+	av1FlagY = 0x40 // last OBU element continues in the next packet
+	av1MaskW = 0x30 // number of OBU elements, 0 for all elements having length
+	av1FlagN = 0x08 // first packet of a coded video sequence
+
+	av1ObuTemporalDelimiter = 2
+)
+
+// depacketizeAV1 appends the complete OBUs of a packet to the current frame
+// in the low overhead bitstream format, starting with a temporal delimiter
+func (i *IVFWriter) depacketizeAV1(payload []byte) error {
+	header := payload[0]
+	payload = payload[1:]
+	count := int(header&av1MaskW) >> 4
+
+	if header&av1FlagZ == 0 {
+		i.obu = nil
+	}
+	for n := 1; len(payload) > 0; n++ {
+		size := len(payload)
+		if count == 0 || n < count {
+			v, l := readLEB128(payload)
+			if l == 0 || int(v) > len(payload)-l {
+				i.obu = nil
+				return fmt.Errorf("invalid av1 obu element length")
+			}
+			size, payload = int(v), payload[l:]
+		}
+		i.obu = append(i.obu, payload[:size]...)
+		payload = payload[size:]
+
+		if len(payload) == 0 && header&av1FlagY != 0 {
+			break // continued in the next packet
+		}
+		i.appendOBU(i.obu)
+		i.obu = nil
+	}
+	return nil
+}
+
+func (i *IVFWriter) appendOBU(obu []byte) {
+	if len(obu) == 0 {
+		return
+	}
+	if len(i.currentFrame) == 0 {
+		i.currentFrame = append(i.currentFrame, av1ObuTemporalDelimiter<<3|0x02, 0)
+	}
+	if (obu[0]>>3)&0x0F == av1ObuTemporalDelimiter {
+		return
+	}
+
+	hsize := 1
+	if obu[0]&0x04 != 0 { // extension flag
+		hsize = 2
+	}
+	if len(obu) < hsize {
+		return
+	}
+	if obu[0]&0x02 != 0 { // already has size field
+		i.currentFrame = append(i.currentFrame, obu...)
+		return
+	}
+	i.currentFrame = append(i.currentFrame, obu[0]|0x02)
+	i.currentFrame = append(i.currentFrame, obu[1:hsize]...)
+	i.currentFrame = appendLEB128(i.currentFrame, uint64(len(obu)-hsize))
+	i.currentFrame = append(i.currentFrame, obu[hsize:]...)
+}
+
+func readLEB128(b []byte) (v uint64, n int) {
+	for n < len(b) && n < 8 {
+		v |= uint64(b[n]&0x7F) << (7 * n)
+		n++
+		if b[n-1]&0x80 == 0 {
+			return
+		}
+	}
+	return 0, 0
+}
+
+func appendLEB128(b []byte, v uint64) []byte {
+	for {
+		c := byte(v & 0x7F)
+		v >>= 7
+		if v != 0 {
+			b = append(b, c|0x80)
+			continue
+		}
+		return append(b, c)
+	}
+}
+
+//=================================================================================
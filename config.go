@@ -0,0 +1,164 @@
+//=================================================================================
+//	Filaname: config.go
+// 	Function: configuration of program by file, environment and flags
+// 	Author: Stoney Kang, sikang@teamgrit.kr
+// 	Copyright: TeamGRIT, 2021
+//=================================================================================
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+//---------------------------------------------------------------------------------
+// EnvPrefix is prepended to the upper cased json name of a setting, SPIDER_VIEW_CHANNEL_ID
+const EnvPrefix = "SPIDER_VIEW_"
+
+//---------------------------------------------------------------------------------
+// configure layers the settings over the defaults in order of
+// config file, environment variables and command line flags
+func (d *Program) configure(name string) (err error) {
+	log.Println("i.configure:", name)
+
+	// keep the flags given explicitly to apply them last
+	given := map[string]string{}
+	flag.Visit(func(f *flag.Flag) {
+		given[f.Name] = f.Value.String()
+	})
+
+	if name != "" {
+		err = d.loadConfig(name)
+		if err != nil {
+			return
+		}
+	}
+
+	err = d.loadEnv(EnvPrefix)
+	if err != nil {
+		return
+	}
+
+	for k, v := range given {
+		err = flag.Set(k, v)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// loadConfig reads a json or yaml file into the settings
+func (d *Program) loadConfig(name string) (err error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return
+	}
+
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".yaml", ".yml":
+		// convert to json to use the same names of settings
+		var v interface{}
+		err = yaml.Unmarshal(data, &v)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		data, err = json.Marshal(v)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+
+	err = json.Unmarshal(data, d)
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	return
+}
+
+// loadEnv sets the settings of string, int and bool from environment variables
+func (d *Program) loadEnv(prefix string) (err error) {
+	v := reflect.ValueOf(d).Elem()
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		key := prefix + strings.ToUpper(name)
+		s, ok := os.LookupEnv(key)
+		if !ok {
+			continue
+		}
+
+		field := v.Field(i)
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(s)
+		case reflect.Int:
+			n, err := strconv.Atoi(s)
+			if err != nil {
+				return fmt.Errorf("%s: %v", key, err)
+			}
+			field.SetInt(int64(n))
+		case reflect.Bool:
+			b, err := strconv.ParseBool(s)
+			if err != nil {
+				return fmt.Errorf("%s: %v", key, err)
+			}
+			field.SetBool(b)
+		default:
+			// structured settings are given by json in the variable
+			err = json.Unmarshal([]byte(s), field.Addr().Interface())
+			if err != nil {
+				return fmt.Errorf("%s: %v", key, err)
+			}
+		}
+	}
+	return
+}
+
+// dumpConfig prints the effective settings in json, with the secrets redacted
+func (d *Program) dumpConfig() (err error) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	return enc.Encode(d.redacted())
+}
+
+// redacted returns a copy of the settings to show, without the secrets
+func (d *Program) redacted() *Program {
+	v := reflect.New(reflect.ValueOf(d).Elem().Type())
+	v.Elem().Set(reflect.ValueOf(d).Elem())
+	c := v.Interface().(*Program)
+
+	for _, s := range []*string{&c.ICEPass, &c.ICESecret, &c.AuthToken, &c.AuthPass, &c.SignSecret} {
+		*s = redact(*s)
+	}
+	c.ICEServers = nil
+	for _, s := range d.ICEServers {
+		s.Credential, s.Secret = redact(s.Credential), redact(s.Secret)
+		c.ICEServers = append(c.ICEServers, s)
+	}
+	return c
+}
+
+// redact hides a secret, but leaves it empty if not set
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return "********"
+}
+
+//=================================================================================
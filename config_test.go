@@ -0,0 +1,149 @@
+//=================================================================================
+//	Filaname: config_test.go
+// 	Function: tests of the configuration by file, environment and flags
+// 	Author: Stoney Kang, sikang@teamgrit.kr
+// 	Copyright: TeamGRIT, 2021
+//=================================================================================
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+//---------------------------------------------------------------------------------
+func TestConfigure(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string // name of the config file, with its data
+		data     string
+		env      map[string]string
+		args     []string
+		channel  string
+		area     int
+		headless bool
+	}{
+		{"defaults", "", "", nil, nil, "default", 3000, false},
+		{"json file", "config.json", `{"channel_id":"file","motion_min_area":100}`, nil, nil, "file", 100, false},
+		{"yaml file", "config.yaml", "channel_id: file\nheadless: true\n", nil, nil, "file", 3000, true},
+		{"env over file", "config.json", `{"channel_id":"file","motion_min_area":100}`,
+			map[string]string{"SPIDER_VIEW_CHANNEL_ID": "env", "SPIDER_VIEW_HEADLESS": "true"}, nil, "env", 100, true},
+		{"flag over env", "config.json", `{"channel_id":"file","motion_min_area":100}`,
+			map[string]string{"SPIDER_VIEW_CHANNEL_ID": "env", "SPIDER_VIEW_MOTION_MIN_AREA": "200"},
+			[]string{"-channel", "flag"}, "flag", 200, false},
+		{"flag of default value", "config.json", `{"motion_min_area":100}`, nil,
+			[]string{"-marea", "3000"}, "default", 3000, false},
+	}
+
+	defer func(fs *flag.FlagSet) { flag.CommandLine = fs }(flag.CommandLine)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &Program{ChannelID: "default", MotionMinArea: 3000}
+			flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+			flag.StringVar(&d.ChannelID, "channel", d.ChannelID, "")
+			flag.IntVar(&d.MotionMinArea, "marea", d.MotionMinArea, "")
+			flag.BoolVar(&d.Headless, "headless", d.Headless, "")
+			if err := flag.CommandLine.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			name := ""
+			if tt.file != "" {
+				name = filepath.Join(t.TempDir(), tt.file)
+				if err := os.WriteFile(name, []byte(tt.data), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := d.configure(name); err != nil {
+				t.Fatal(err)
+			}
+			if d.ChannelID != tt.channel || d.MotionMinArea != tt.area || d.Headless != tt.headless {
+				t.Errorf("configure = %s %d %v, want %s %d %v",
+					d.ChannelID, d.MotionMinArea, d.Headless, tt.channel, tt.area, tt.headless)
+			}
+		})
+	}
+}
+
+func TestLoadEnv(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		want *Program
+		ok   bool
+	}{
+		{"none", nil, &Program{}, true},
+		{"string", map[string]string{"T_CHANNEL_ID": "cam1"}, &Program{ChannelID: "cam1"}, true},
+		{"int", map[string]string{"T_RECORD_KEEP": "10"}, &Program{RecordKeep: 10}, true},
+		{"bool", map[string]string{"T_RECORD": "1", "T_HEADLESS": "false"}, &Program{Record: true}, true},
+		{"json", map[string]string{"T_ZONES": `{"cam1":[{"name":"door","points":[[0,0],[1,0],[1,1]]}]}`},
+			&Program{Zones: map[string][]Zone{"cam1": {{Name: "door", Points: [][2]float64{{0, 0}, {1, 0}, {1, 1}}}}}}, true},
+		{"not prefixed", map[string]string{"CHANNEL_ID": "cam1"}, &Program{}, true},
+		{"bad int", map[string]string{"T_RECORD_KEEP": "ten"}, &Program{}, false},
+		{"bad bool", map[string]string{"T_RECORD": "yes"}, &Program{}, false},
+		{"bad json", map[string]string{"T_ZONES": "door"}, &Program{}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			d := &Program{}
+			err := d.loadEnv("T_")
+			if (err == nil) != tt.ok {
+				t.Fatalf("loadEnv = %v, want ok %v", err, tt.ok)
+			}
+			if tt.ok && !reflect.DeepEqual(d, tt.want) {
+				t.Errorf("loadEnv = %+v, want %+v", d, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedacted(t *testing.T) {
+	tests := []struct {
+		name    string
+		secret  string
+		display string
+	}{
+		{"set", "secret", "********"},
+		{"not set", "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &Program{
+				ChannelID:  "cam1",
+				ICEPass:    tt.secret,
+				ICESecret:  tt.secret,
+				AuthToken:  tt.secret,
+				AuthPass:   tt.secret,
+				SignSecret: tt.secret,
+				ICEServers: []ICEServerConfig{{URLs: []string{"turn:a"}, Username: "u", Credential: tt.secret, Secret: tt.secret}},
+			}
+			c := d.redacted()
+
+			for _, s := range []string{c.ICEPass, c.ICESecret, c.AuthToken, c.AuthPass, c.SignSecret,
+				c.ICEServers[0].Credential, c.ICEServers[0].Secret} {
+				if s != tt.display {
+					t.Errorf("redacted %q, want %q", s, tt.display)
+				}
+			}
+			if c.ChannelID != "cam1" || c.ICEServers[0].Username != "u" {
+				t.Errorf("redacted %s %s, want cam1 u", c.ChannelID, c.ICEServers[0].Username)
+			}
+			if d.AuthToken != tt.secret || d.ICEServers[0].Credential != tt.secret {
+				t.Errorf("settings changed by redacted")
+			}
+		})
+	}
+}
+
+//=================================================================================
@@ -0,0 +1,367 @@
+//=================================================================================
+//	Filaname: control.go
+// 	Function: http api to control the running viewer
+// 	Author: Stoney Kang, sikang@teamgrit.kr
+// 	Copyright: TeamGRIT, 2021
+//=================================================================================
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/pion/rtcp"
+)
+
+//---------------------------------------------------------------------------------
+// ChannelStatus is the status of a channel given by the control api
+type ChannelStatus struct {
+	Channel   string       `json:"channel"`
+	State     string       `json:"state"` // connecting, connected, disconnected or rejected
+	Since     time.Time    `json:"since"`
+	ICEState  string       `json:"ice_state,omitempty"`
+	Codec     string       `json:"codec,omitempty"`
+	Width     int          `json:"width,omitempty"`
+	Height    int          `json:"height,omitempty"`
+	Bitrate   int          `json:"bitrate"` // bps of video received
+	Recording bool         `json:"recording"`
+	Motion    bool         `json:"motion"`
+	Zones     []ZoneMotion `json:"zones,omitempty"` // motion of include zones
+}
+
+type Status struct {
+	Version  string          `json:"version"`
+	Channels []ChannelStatus `json:"channels"`
+}
+
+//---------------------------------------------------------------------------------
+// serveControl runs the control api until the program quits
+func (d *Program) serveControl() {
+	log.Println("i.serveControl:", d.HTTPAddr)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", d.handleStatus)
+	mux.HandleFunc("/channel", d.handleChannel)
+	mux.HandleFunc("/keyframe", d.handleKeyFrame)
+	mux.HandleFunc("/record/start", d.handleRecord)
+	mux.HandleFunc("/record/stop", d.handleRecord)
+	mux.HandleFunc("/snapshot", d.handleSnapshot)
+	mux.HandleFunc("/shutdown", d.handleShutdown)
+	mux.HandleFunc("/metrics", d.handleMetrics)
+
+	srv := &http.Server{Addr: d.HTTPAddr, Handler: mux}
+	go func() {
+		<-d.ctx.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	}()
+
+	err := srv.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		log.Println(err)
+	}
+}
+
+// programs returns the programs of channels, itself if not a grid
+func (d *Program) programs() []*Program {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.children) > 0 {
+		return append([]*Program(nil), d.children...)
+	}
+	return []*Program{d}
+}
+
+// lookupChannel returns the program of the channel in the query, the first if not given
+func (d *Program) lookupChannel(r *http.Request) (p *Program, err error) {
+	progs := d.programs()
+	id := r.URL.Query().Get("channel")
+	if id == "" {
+		return progs[0], nil
+	}
+	for _, p = range progs {
+		if p.channel() == id {
+			return
+		}
+	}
+	return nil, fmt.Errorf("unknown channel: %s", id)
+}
+
+//---------------------------------------------------------------------------------
+func (d *Program) handleStatus(w http.ResponseWriter, r *http.Request) {
+	status := Status{Version: Version}
+	for _, p := range d.programs() {
+		status.Channels = append(status.Channels, p.status())
+	}
+	writeJSON(w, status)
+}
+
+// handleChannel switches the channel, POST /channel?channel=old&to=new
+func (d *Program) handleChannel(w http.ResponseWriter, r *http.Request) {
+	p, ok := d.lookupPost(w, r)
+	if !ok {
+		return
+	}
+	to := r.URL.Query().Get("to")
+	if to == "" {
+		http.Error(w, "no channel to switch", http.StatusBadRequest)
+		return
+	}
+	if err := checkChannel(to); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err := p.switchChannel(to)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, p.status())
+}
+
+func (d *Program) handleKeyFrame(w http.ResponseWriter, r *http.Request) {
+	p, ok := d.lookupPost(w, r)
+	if !ok {
+		return
+	}
+	err := p.requestKeyFrame()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (d *Program) handleRecord(w http.ResponseWriter, r *http.Request) {
+	p, ok := d.lookupPost(w, r)
+	if !ok {
+		return
+	}
+	var err error
+	if r.URL.Path == "/record/start" {
+		err = p.startRecord()
+	} else {
+		err = p.stopRecord()
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, p.status())
+}
+
+// handleSnapshot returns the last frame in ?format=jpg|png,
+// or saves it in the snapshot dir by POST with ?save=1
+func (d *Program) handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	p, err := d.lookupChannel(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = d.SnapshotFormat
+	}
+	_, ctype, err := snapshotFormat(format)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if r.URL.Query().Get("save") != "" {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		name, err := p.saveSnapshot(format)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		writeJSON(w, map[string]string{"channel": p.channel(), "file": name})
+		return
+	}
+
+	data, err := p.snapshot(format)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", ctype)
+	w.Write(data)
+}
+
+func (d *Program) handleShutdown(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	log.Println("shutdown by control api")
+	w.WriteHeader(http.StatusAccepted)
+	d.shutdown()
+}
+
+// lookupPost checks the method of an action and returns the program of the channel
+func (d *Program) lookupPost(w http.ResponseWriter, r *http.Request) (p *Program, ok bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	p, err := d.lookupChannel(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	return p, true
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+//---------------------------------------------------------------------------------
+// status returns the status of the channel
+func (d *Program) status() (s ChannelStatus) {
+	s.State, s.Since = d.State()
+
+	d.mu.Lock()
+	s.Channel = d.ChannelID
+	s.ICEState = d.iceState
+	s.Recording = d.recorder != nil
+	d.mu.Unlock()
+
+	// no decoder before the media is open, and in the grid of channels
+	if decoder := d.getDecoder(); decoder != nil {
+		info := decoder.StreamInfo()
+		s.Codec = info.Codec
+		s.Width, s.Height = info.Width, info.Height
+	}
+	s.Bitrate = d.stats.Bitrate()
+	motion := d.LastMotion()
+	s.Motion = motion.Detected
+	s.Zones = motion.Zones
+	return
+}
+
+// channel returns the channel id, switched by the control api
+func (d *Program) channel() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.ChannelID
+}
+
+// channelPattern is the form of channel ids, put in the names of files and in urls
+var channelPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// checkChannel tells whether the channel id is safe to be a part of paths and urls
+func checkChannel(id string) error {
+	if !channelPattern.MatchString(id) {
+		return fmt.Errorf("invalid channel id: %q", id)
+	}
+	return nil
+}
+
+// switchChannel subscribes another channel by restarting the session.
+// Recording and clips go on to the files of the new channel.
+func (d *Program) switchChannel(id string) (err error) {
+	log.Println("i.switchChannel:", id)
+
+	err = checkChannel(id)
+	if err != nil {
+		return
+	}
+
+	d.mu.Lock()
+	d.ChannelID = id
+	d.URL = d.channelURL(id)
+	recording := d.recorder != nil
+	clips := d.clips
+	d.mu.Unlock()
+
+	if recording {
+		d.stopRecord()
+		err = d.startRecord()
+	}
+	if clips != nil {
+		clips.SetChannel(id)
+	}
+	d.restartSession()
+	return
+}
+
+// restartSession stops the current session to be reconnected by the supervisor
+func (d *Program) restartSession() {
+	d.mu.Lock()
+	stop := d.stopSession
+	d.mu.Unlock()
+	if stop != nil {
+		stop()
+	}
+}
+
+// requestKeyFrame sends PLI for the video track of the session
+func (d *Program) requestKeyFrame() error {
+	d.mu.Lock()
+	pc, ssrc := d.pc, d.videoSSRC
+	d.mu.Unlock()
+	if pc == nil || ssrc == 0 {
+		return fmt.Errorf("no video track")
+	}
+	d.pipeline.pliSent()
+	return pc.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: ssrc}})
+}
+
+// getDecoder returns the decoder, nil before the media is open
+func (d *Program) getDecoder() Decoder {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.decoder
+}
+
+// getRecorder returns the recorder, nil if not recording
+func (d *Program) getRecorder() *Recorder {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.recorder
+}
+
+// startRecord starts recording from the next key frame
+func (d *Program) startRecord() (err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.recorder != nil {
+		return
+	}
+	d.recorder, err = NewRecorder(d.RecordDir, d.ChannelID, d.VideoCodec, d.RecordFormat,
+		time.Duration(d.RecordSegment)*time.Second, int64(d.RecordSize)<<20, d.RecordKeep)
+	if err != nil {
+		return
+	}
+	d.recorder.Saved = d.segmentSaved
+	d.recorder.Rotate()
+	go d.requestKeyFrame()
+	return
+}
+
+// stopRecord closes the segment being recorded
+func (d *Program) stopRecord() (err error) {
+	d.mu.Lock()
+	r := d.recorder
+	d.recorder = nil
+	d.mu.Unlock()
+	if r != nil {
+		err = r.Close()
+	}
+	return
+}
+
+//=================================================================================
@@ -0,0 +1,56 @@
+//=================================================================================
+//	Filaname: control_test.go
+// 	Function: tests of the http control api
+// 	Author: Stoney Kang, sikang@teamgrit.kr
+// 	Copyright: TeamGRIT, 2021
+//=================================================================================
+package main
+
+import (
+	"testing"
+)
+
+//---------------------------------------------------------------------------------
+func TestCheckChannel(t *testing.T) {
+	tests := []struct {
+		id string
+		ok bool
+	}{
+		{"bq5ame6g10l3jia3h0ng", true},
+		{"cam_1-front", true},
+		{"", false},
+		{"../etc", false},
+		{"a/b", false},
+		{"a&token=x", false},
+		{"a b", false},
+		{"채널", false},
+	}
+
+	for _, tt := range tests {
+		if err := checkChannel(tt.id); (err == nil) != tt.ok {
+			t.Errorf("checkChannel(%q) = %v, want ok %v", tt.id, err, tt.ok)
+		}
+	}
+}
+
+func TestChannelURL(t *testing.T) {
+	tests := []struct {
+		template string
+		channel  string
+		url      string
+	}{
+		{"", "cam1", "wss://spider/live/ws/sub?channel=cam1&vcodec=h264"},
+		{"", "a&b", "wss://spider/live/ws/sub?channel=a%26b&vcodec=h264"},
+		{"https://host/whep/{channel}", "cam1", "https://host/whep/cam1"},
+		{"https://host/whep?stream={channel}", "a&x=1", "https://host/whep?stream=a%26x%3D1"},
+	}
+
+	for _, tt := range tests {
+		d := &Program{SpiderServer: "spider", VideoCodec: "h264", urlTemplate: tt.template}
+		if url := d.channelURL(tt.channel); url != tt.url {
+			t.Errorf("channelURL(%q) = %s, want %s", tt.channel, url, tt.url)
+		}
+	}
+}
+
+//=================================================================================
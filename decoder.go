@@ -0,0 +1,402 @@
+//=================================================================================
+//	Filaname: decoder.go
+// 	Function: video decoders giving raw frames from the received stream
+// 	Author: Stoney Kang, sikang@teamgrit.kr
+// 	Copyright: TeamGRIT, 2021
+//=================================================================================
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//---------------------------------------------------------------------------------
+var (
+	// ErrDecoderRestarted is returned by Write once after the decoder is restarted,
+	// the stream must be written again from its container header and a key frame
+	ErrDecoderRestarted = errors.New("decoder restarted")
+	ErrDecoderClosed    = errors.New("decoder closed")
+)
+
+// Frame is a decoded video frame in bgr24
+type Frame struct {
+	Data   []byte
+	Width  int
+	Height int
+	Time   time.Time // time when the frame is decoded
+	Seq    uint64
+}
+
+// Decoder takes the encoded stream in the container of its codec (annex-b or ivf)
+// and gives decoded frames
+type Decoder interface {
+	io.Writer
+	ReadFrame() (*Frame, error)
+	SetStreamInfo(info StreamInfo) error // native format found in the stream
+	StreamInfo() StreamInfo
+	Close() error
+}
+
+// Policies to scale decoded frames
+const (
+	ScaleNative = "native" // native size of the stream
+	ScaleFit    = "fit"    // fit in the size keeping aspect ratio, not enlarged
+	ScaleFixed  = "fixed"  // always the size
+)
+
+// DecoderConfig is given to create a decoder
+type DecoderConfig struct {
+	Codec  string // h264, vp8, vp9 or av1
+	Scale  string // native, fit or fixed
+	Width  int    // size of output frames to fit or fix
+	Height int
+}
+
+// decoders are the available decoder implementations by name,
+// an in-process decoder can be added here without changing the viewer
+var decoders = map[string]func(DecoderConfig) (Decoder, error){
+	"ffmpeg": newFFmpegDecoder,
+}
+
+//---------------------------------------------------------------------------------
+func NewDecoder(kind string, config DecoderConfig) (dec Decoder, err error) {
+	log.Println("i.NewDecoder:", kind, config)
+
+	newDecoder, ok := decoders[kind]
+	if !ok {
+		err = fmt.Errorf("unknown decoder: %s", kind)
+		return
+	}
+	return newDecoder(config)
+}
+
+//---------------------------------------------------------------------------------
+const (
+	ffmpegRestartDelay = time.Second
+	ffmpegStallTimeout = 10 * time.Second // restart if written but no frame for this time
+)
+
+// ffmpegDecoder pipes the stream to a ffmpeg process, restarting it when it dies or stalls
+type ffmpegDecoder struct {
+	config DecoderConfig
+	format string
+	frames chan *Frame
+	done   chan struct{}
+
+	mu        sync.Mutex
+	info      StreamInfo
+	width     int // size of output frames, 0 if not known yet
+	height    int
+	cmd       *exec.Cmd
+	stdin     io.WriteCloser
+	restarted bool
+	closed    bool
+	lastWrite time.Time
+	lastFrame time.Time
+	restarts  int
+	wg        sync.WaitGroup
+}
+
+func newFFmpegDecoder(config DecoderConfig) (dec Decoder, err error) {
+	vc, err := lookupVideoCodec(config.Codec)
+	if err != nil {
+		return
+	}
+	switch config.Scale {
+	case ScaleNative, ScaleFit, ScaleFixed:
+	default:
+		err = fmt.Errorf("unknown scale policy: %s", config.Scale)
+		return
+	}
+
+	f := &ffmpegDecoder{
+		config: config,
+		format: vc.format,
+		info:   StreamInfo{Codec: config.Codec},
+		frames: make(chan *Frame, 2),
+		done:   make(chan struct{}),
+	}
+	f.width, f.height = outputSize(config, f.info)
+	if f.width > 0 {
+		err = f.start()
+		if err != nil {
+			return
+		}
+	}
+
+	f.wg.Add(1)
+	go f.watch()
+	dec = f
+	return
+}
+
+// outputSize returns the size of frames by the scale policy, 0 if not known yet
+func outputSize(config DecoderConfig, info StreamInfo) (width, height int) {
+	switch config.Scale {
+	case ScaleFixed:
+		return config.Width, config.Height
+	case ScaleNative:
+		return info.Width, info.Height
+	}
+
+	if info.Width == 0 || info.Height == 0 {
+		return
+	}
+	width, height = info.Width, info.Height
+	if width > config.Width || height > config.Height {
+		if width*config.Height > height*config.Width {
+			width, height = config.Width, height*config.Width/width
+		} else {
+			width, height = width*config.Height/height, config.Height
+		}
+	}
+	return width &^ 1, height &^ 1
+}
+
+// start launches a ffmpeg process and its reader, called with mu locked or before use
+func (f *ffmpegDecoder) start() (err error) {
+	log.Println("i.ffmpegDecoder.start:", f.format, "bgr24", f.width, f.height)
+
+	size := strconv.Itoa(f.width) + "x" + strconv.Itoa(f.height)
+	cmd := exec.Command("ffmpeg", "-f", f.format, "-i", "pipe:0", "-pix_fmt", "bgr24", "-s",
+		size, "-f", "rawvideo", "pipe:1") //nolint
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	f.cmd, f.stdin = cmd, stdin
+	f.lastWrite, f.lastFrame = time.Time{}, time.Now()
+
+	go func() {
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			log.Println(scanner.Text())
+		}
+	}()
+
+	f.wg.Add(1)
+	go f.readFrames(cmd, stdout, f.width, f.height)
+	return
+}
+
+// readFrames reads raw frames of a process until it exits, then restarts it
+func (f *ffmpegDecoder) readFrames(cmd *exec.Cmd, stdout io.Reader, width, height int) {
+	defer f.wg.Done()
+
+	var seq uint64
+loop:
+	for {
+		buf := make([]byte, width*height*3)
+		_, err := io.ReadFull(stdout, buf)
+		if err != nil {
+			log.Println("ffmpeg:", err)
+			break
+		}
+
+		seq++
+		frame := &Frame{
+			Data:   buf,
+			Width:  width,
+			Height: height,
+			Time:   time.Now(),
+			Seq:    seq,
+		}
+		f.mu.Lock()
+		f.lastFrame = frame.Time
+		f.mu.Unlock()
+
+		select {
+		case f.frames <- frame:
+		case <-f.done:
+			break loop
+		}
+	}
+
+	err := cmd.Wait()
+	log.Println("ffmpeg exited:", err)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for !f.closed && f.cmd == cmd {
+		f.mu.Unlock()
+		select {
+		case <-f.done:
+			f.mu.Lock()
+			return
+		case <-time.After(ffmpegRestartDelay):
+		}
+		f.mu.Lock()
+		if f.closed || f.cmd != cmd {
+			return
+		}
+		f.restarts++
+		f.restarted = true
+		log.Println("ffmpeg restart:", f.restarts)
+		if f.start() == nil {
+			return
+		}
+	}
+}
+
+// watch kills a process which takes the stream but gives no frame,
+// and starts again a process failed to start by SetStreamInfo
+func (f *ffmpegDecoder) watch() {
+	defer f.wg.Done()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-f.done:
+			return
+		case <-ticker.C:
+		}
+
+		f.mu.Lock()
+		if f.cmd != nil && f.lastWrite.After(f.lastFrame) && time.Since(f.lastFrame) > ffmpegStallTimeout {
+			log.Println("ffmpeg stalled, kill:", f.cmd.Process.Pid)
+			f.cmd.Process.Kill()
+			f.lastFrame = time.Now()
+		}
+		if f.cmd == nil && f.width > 0 {
+			f.restarts++
+			f.restarted = true
+			log.Println("ffmpeg restart:", f.restarts)
+			f.start()
+		}
+		f.mu.Unlock()
+	}
+}
+
+// Write passes the stream to the process. The pipe is written without mu,
+// so that watch and Close can kill the process while ffmpeg does not read.
+func (f *ffmpegDecoder) Write(p []byte) (n int, err error) {
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		return 0, ErrDecoderClosed
+	}
+	if f.restarted {
+		f.restarted = false
+		f.mu.Unlock()
+		return 0, ErrDecoderRestarted
+	}
+	if f.cmd == nil {
+		f.mu.Unlock()
+		return len(p), nil // discard until the size is known or watch starts the process
+	}
+	stdin := f.stdin
+	f.lastWrite = time.Now()
+	f.mu.Unlock()
+
+	n, err = stdin.Write(p)
+	if err != nil {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if f.closed {
+			return n, ErrDecoderClosed
+		}
+		if f.stdin != stdin {
+			// the process is replaced, the next write tells the restart
+			return len(p), nil
+		}
+	}
+	return
+}
+
+// SetStreamInfo restarts the process if the size of output frames is changed.
+// If the process fails to start, watch tries it again after a while.
+func (f *ffmpegDecoder) SetStreamInfo(info StreamInfo) (err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed || info == f.info {
+		return
+	}
+	f.info = info
+	width, height := outputSize(f.config, info)
+	if width == f.width && height == f.height && f.cmd != nil {
+		return
+	}
+	log.Println("i.ffmpegDecoder.SetStreamInfo:", info, "output:", width, height)
+
+	if f.cmd != nil {
+		f.stdin.Close()
+		f.cmd.Process.Kill()
+		f.cmd = nil // let the reader of the process exit
+	}
+	f.width, f.height = width, height
+	f.restarted = true
+	err = f.start()
+	if err != nil {
+		err = fmt.Errorf("ffmpeg not started, retry after %v: %w", ffmpegRestartDelay, err)
+	}
+	return
+}
+
+func (f *ffmpegDecoder) StreamInfo() StreamInfo {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.info
+}
+
+// Restarts returns the number of restarts after the process exited
+func (f *ffmpegDecoder) Restarts() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.restarts
+}
+
+func (f *ffmpegDecoder) ReadFrame() (frame *Frame, err error) {
+	select {
+	case frame = <-f.frames:
+		return
+	case <-f.done:
+		return nil, io.EOF
+	}
+}
+
+// Close terminates the process and waits until it is reaped
+func (f *ffmpegDecoder) Close() (err error) {
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		return
+	}
+	f.closed = true
+	close(f.done)
+	if f.cmd != nil {
+		f.stdin.Close()
+		f.cmd.Process.Kill()
+	}
+	f.mu.Unlock()
+
+	f.wg.Wait()
+	log.Println("o.ffmpegDecoder.Close:", f.restarts, "restarts")
+	return
+}
+
+//=================================================================================
@@ -0,0 +1,284 @@
+//=================================================================================
+//	Filaname: events.go
+// 	Function: events of the viewer sent to webhooks, json-lines files or stdout
+// 	Author: Stoney Kang, sikang@teamgrit.kr
+// 	Copyright: TeamGRIT, 2021
+//=================================================================================
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+//---------------------------------------------------------------------------------
+// Types of events
+const (
+	EventMotionStart    = "motion_start"
+	EventMotionStop     = "motion_stop"
+	EventICEState       = "ice_state"
+	EventTrackAdded     = "track_added"
+	EventDecoderRestart = "decoder_restart"
+	EventRecordSaved    = "record_saved"
+)
+
+const (
+	eventQueueSize  = 256
+	motionStopAfter = 2 * time.Second // time without motion to send motion stop
+	webhookTimeout  = 5 * time.Second
+	webhookRetries  = 3
+	webhookRetryMin = 500 * time.Millisecond
+)
+
+// Event is a thing happened in a channel, sent to the sinks in json
+type Event struct {
+	Time    time.Time   `json:"time"`
+	Type    string      `json:"type"`
+	Channel string      `json:"channel"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+// EventSink sends the events to somewhere outside
+type EventSink interface {
+	Send(e Event) error
+	Close() error
+}
+
+//---------------------------------------------------------------------------------
+// eventBus passes the events to the sinks, each with its own queue
+// not to be delayed by a slow one
+type eventBus struct {
+	mu     sync.Mutex
+	closed bool
+	queues []chan Event
+	done   chan struct{} // closed at Close, not to retry any more
+	wg     sync.WaitGroup
+}
+
+// newEventBus returns the bus to the sinks of stdout, http(s) webhook urls or files
+func newEventBus(specs []string) (b *eventBus, err error) {
+	log.Println("i.newEventBus:", specs)
+
+	b = &eventBus{done: make(chan struct{})}
+	sinks := []EventSink{}
+	for _, spec := range specs {
+		var sink EventSink
+		switch {
+		case spec == "stdout":
+			sink = &writerSink{w: os.Stdout}
+		case strings.HasPrefix(spec, "http://"), strings.HasPrefix(spec, "https://"):
+			sink = &webhookSink{url: spec, client: &http.Client{Timeout: webhookTimeout}, done: b.done}
+		default:
+			f, err := os.OpenFile(spec, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+			if err != nil {
+				for _, s := range sinks {
+					s.Close()
+				}
+				return nil, err
+			}
+			sink = &writerSink{w: f, c: f}
+		}
+		sinks = append(sinks, sink)
+	}
+
+	for _, sink := range sinks {
+		q := make(chan Event, eventQueueSize)
+		b.queues = append(b.queues, q)
+		b.wg.Add(1)
+		go b.run(sink, q)
+	}
+	return
+}
+
+func (b *eventBus) run(sink EventSink, q chan Event) {
+	defer b.wg.Done()
+	defer sink.Close()
+
+	for e := range q {
+		err := sink.Send(e)
+		if err != nil {
+			log.Println("event:", e.Type, err)
+		}
+	}
+}
+
+// Publish queues the event to the sinks, dropped if a queue is full
+func (b *eventBus) Publish(e Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+	for _, q := range b.queues {
+		select {
+		case q <- e:
+		default:
+			log.Println("event dropped:", e.Type)
+		}
+	}
+}
+
+// Close sends the queued events and closes the sinks
+func (b *eventBus) Close() {
+	b.mu.Lock()
+	if !b.closed {
+		b.closed = true
+		close(b.done)
+		for _, q := range b.queues {
+			close(q)
+		}
+	}
+	b.mu.Unlock()
+	b.wg.Wait()
+}
+
+//---------------------------------------------------------------------------------
+// writerSink writes the events in json lines, to stdout or a file
+type writerSink struct {
+	w io.Writer
+	c io.Closer
+}
+
+func (s *writerSink) Send(e Event) error {
+	return json.NewEncoder(s.w).Encode(e)
+}
+
+func (s *writerSink) Close() error {
+	if s.c != nil {
+		return s.c.Close()
+	}
+	return nil
+}
+
+// webhookSink posts the events in json, retried on errors of network or server
+// until the bus is closed
+type webhookSink struct {
+	url    string
+	client *http.Client
+	done   <-chan struct{}
+}
+
+func (s *webhookSink) Send(e Event) (err error) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+
+	delay := webhookRetryMin
+	for i := 0; ; i++ {
+		var retry bool
+		retry, err = s.post(body)
+		if err == nil || !retry || i == webhookRetries {
+			return
+		}
+		log.Println("webhook:", err, "- retry after", delay)
+		select {
+		case <-time.After(delay):
+		case <-s.done:
+			return
+		}
+		delay *= 2
+	}
+}
+
+func (s *webhookSink) post(body []byte) (retry bool, err error) {
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode/100 == 2 {
+		return
+	}
+	err = fmt.Errorf("webhook %s: %s", s.url, resp.Status)
+	retry = resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	return
+}
+
+func (s *webhookSink) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
+
+//---------------------------------------------------------------------------------
+// emit publishes the event of the channel, if any sink
+func (d *Program) emit(kind string, data interface{}) {
+	if d.events == nil {
+		return
+	}
+	d.events.Publish(Event{Time: time.Now(), Type: kind, Channel: d.channel(), Data: data})
+}
+
+// motionEvents returns the motion handler sending motion start, and motion stop
+// after no motion for motionStopAfter, not at every frame without motion
+func (d *Program) motionEvents() func(MotionResult) {
+	moving := false
+	var last time.Time
+	var maxArea float64
+
+	return func(res MotionResult) {
+		if res.Detected {
+			if !moving {
+				moving, maxArea = true, 0
+				d.emit(EventMotionStart, map[string]interface{}{"area": res.Area, "boxes": res.Boxes})
+			}
+			last = res.Time
+			if res.Area > maxArea {
+				maxArea = res.Area
+			}
+			return
+		}
+		if moving && res.Time.Sub(last) >= motionStopAfter {
+			moving = false
+			d.emit(EventMotionStop, map[string]interface{}{"max_area": maxArea, "last": last})
+		}
+	}
+}
+
+// decoderRestarted sends the event when the decoder has restarted after a failure,
+// not when it is reconfigured for a new size of the stream
+func (d *Program) decoderRestarted() {
+	rc, ok := d.getDecoder().(restartCounter)
+	if !ok {
+		return
+	}
+	restarts := rc.Restarts()
+
+	d.mu.Lock()
+	if restarts <= d.restartsSent {
+		d.mu.Unlock()
+		return
+	}
+	d.restartsSent = restarts
+	d.mu.Unlock()
+
+	d.emit(EventDecoderRestart, map[string]interface{}{"restarts": restarts})
+}
+
+// recordEvent is the data of record saved, of a segment or a clip
+type recordEvent struct {
+	Kind string    `json:"kind"` // segment or clip
+	File string    `json:"file"`
+	Size int64     `json:"size"`
+	Clip *ClipInfo `json:"clip,omitempty"`
+}
+
+func (d *Program) segmentSaved(name string, size int64) {
+	d.emit(EventRecordSaved, recordEvent{Kind: "segment", File: name, Size: size})
+}
+
+func (d *Program) clipSaved(info ClipInfo) {
+	d.emit(EventRecordSaved, recordEvent{Kind: "clip", File: info.File, Size: info.Bytes, Clip: &info})
+}
+
+//=================================================================================
@@ -0,0 +1,75 @@
+//=================================================================================
+//	Filaname: events_test.go
+// 	Function: tests of the events sent to webhooks
+// 	Author: Stoney Kang, sikang@teamgrit.kr
+// 	Copyright: TeamGRIT, 2021
+//=================================================================================
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+//---------------------------------------------------------------------------------
+func TestWebhookRetry(t *testing.T) {
+	tests := []struct {
+		name   string
+		status []int // of the posts in order
+		closed bool  // bus closed before sending
+		posts  int
+		ok     bool
+	}{
+		{"success", []int{http.StatusNoContent}, false, 1, true},
+		{"server errors then success", []int{http.StatusInternalServerError, http.StatusBadGateway, http.StatusOK}, false, 3, true},
+		{"too many requests", []int{http.StatusTooManyRequests, http.StatusOK}, false, 2, true},
+		{"client error", []int{http.StatusBadRequest, http.StatusOK}, false, 1, false},
+		{"bus closed", []int{http.StatusServiceUnavailable, http.StatusOK}, true, 1, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var events []Event
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var e Event
+				if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+					t.Error(err)
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				events = append(events, e)
+				w.WriteHeader(tt.status[len(events)-1])
+			}))
+			defer server.Close()
+
+			done := make(chan struct{})
+			if tt.closed {
+				close(done)
+			}
+			s := &webhookSink{url: server.URL, client: server.Client(), done: done}
+			defer s.Close()
+
+			err := s.Send(Event{Time: time.Now(), Type: EventMotionStart, Channel: "cam1"})
+			if (err == nil) != tt.ok {
+				t.Errorf("Send = %v, want ok %v", err, tt.ok)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if len(events) != tt.posts {
+				t.Errorf("posts %d, want %d", len(events), tt.posts)
+			}
+			for _, e := range events {
+				if e.Type != EventMotionStart || e.Channel != "cam1" {
+					t.Errorf("event %+v, want motion start of cam1", e)
+				}
+			}
+		})
+	}
+}
+
+//=================================================================================
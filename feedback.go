@@ -0,0 +1,285 @@
+//=================================================================================
+//	Filaname: feedback.go
+// 	Function: rtcp feedback of the receiver, reports, nack, remb and pli on demand
+// 	Author: Stoney Kang, sikang@teamgrit.kr
+// 	Copyright: TeamGRIT, 2021
+//=================================================================================
+package main
+
+import (
+	"log"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v2"
+)
+
+//---------------------------------------------------------------------------------
+const (
+	reportInterval   = time.Second            // of receiver report and remb
+	nackInterval     = 20 * time.Millisecond  // to check missing packets
+	nackRetryAfter   = 100 * time.Millisecond // to send nack again for a packet
+	nackRetries      = 3                      // nacks for a packet before giving up
+	nackMaxMissing   = 512                    // a larger gap needs a key frame
+	pliInterval      = time.Second            // min interval of pli while a key frame is needed
+	rembMinBitrate   = 100_000
+	rembStartBitrate = 1_000_000
+)
+
+// nackWindow is the max time from a packet found missing until nack gives it up,
+// the default latency of the jitter buffer not to drop the retransmission
+const nackWindow = nackInterval + nackRetries*(nackRetryAfter+nackInterval)
+
+// videoFeedback is the rtcp feedback of video codecs negotiated in the sdp
+var videoFeedback = []webrtc.RTCPFeedback{
+	{Type: "goog-remb"},
+	{Type: "nack"},
+	{Type: "nack", Parameter: "pli"},
+}
+
+type nackState struct {
+	first time.Time
+	last  time.Time
+	sent  int
+}
+
+// feedback sends rtcp of the receiver for a track. Receiver reports are sent for
+// all tracks, and nack, remb and pli for video only.
+type feedback struct {
+	pc       *webrtc.PeerConnection
+	video    bool
+	ssrc     uint32 // of ours as a receiver
+	stats    *receiveStats
+	pipeline *pipelineStats
+	pli      func() error
+
+	mu         sync.Mutex
+	mediaSSRC  uint32
+	lastSeq    uint16
+	started    bool
+	missing    map[uint16]*nackState
+	lastSR     uint32 // middle 32 bits of ntp time of the last sender report
+	lastSRTime time.Time
+	estimate   float64 // bps of remb
+	needKey    bool
+	lastPLI    time.Time
+}
+
+func (d *Program) newFeedback(pc *webrtc.PeerConnection, video bool) *feedback {
+	f := &feedback{
+		pc:       pc,
+		video:    video,
+		ssrc:     rand.Uint32(),
+		stats:    &d.astats,
+		pipeline: &d.pipeline,
+		pli:      d.requestKeyFrame,
+		missing:  map[uint16]*nackState{},
+		estimate: rembStartBitrate,
+		needKey:  video, // until the first key frame
+	}
+	if video {
+		f.stats = &d.stats
+	}
+	return f
+}
+
+// received tracks the missing packets by the sequence number
+func (f *feedback) received(pkt *rtp.Packet, keyFrame bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if keyFrame && f.needKey {
+		f.needKey = false
+		f.missing = map[uint16]*nackState{}
+	}
+	if !f.started || pkt.SSRC != f.mediaSSRC {
+		f.mediaSSRC, f.lastSeq, f.started = pkt.SSRC, pkt.SequenceNumber, true
+		return
+	}
+
+	seq := pkt.SequenceNumber
+	delta := seq - f.lastSeq
+	switch {
+	case delta == 0:
+	case delta < 0x8000:
+		// newer, the packets between are missing
+		if f.video && delta > 1 {
+			if int(delta)-1+len(f.missing) > nackMaxMissing {
+				log.Println("feedback: too many missing,", delta-1)
+				f.missing = map[uint16]*nackState{}
+				f.needKey = true
+			} else {
+				now := time.Now()
+				for s := f.lastSeq + 1; s != seq; s++ {
+					f.missing[s] = &nackState{first: now}
+				}
+			}
+		}
+		f.lastSeq = seq
+	default:
+		// older, retransmitted or reordered
+		delete(f.missing, seq)
+	}
+}
+
+// senderReport keeps the time of the last sender report for the receiver report
+func (f *feedback) senderReport(sr *rtcp.SenderReport) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lastSR = uint32(sr.NTPTime >> 16)
+	f.lastSRTime = time.Now()
+}
+
+// requestKeyFrame asks a key frame until one is received
+func (f *feedback) requestKeyFrame() {
+	f.mu.Lock()
+	f.needKey = true
+	f.lastPLI = time.Time{}
+	f.mu.Unlock()
+	f.sendPLI()
+}
+
+// needKeyFrame asks a key frame at the next interval
+func (f *feedback) needKeyFrame() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.needKey = true
+}
+
+// run sends the feedback periodically until done
+func (f *feedback) run(done chan struct{}) {
+	nackTicker := time.NewTicker(nackInterval)
+	defer nackTicker.Stop()
+	reportTicker := time.NewTicker(reportInterval)
+	defer reportTicker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-nackTicker.C:
+			if f.video {
+				f.sendNACK()
+				f.sendPLI()
+			}
+		case <-reportTicker.C:
+			f.sendReports()
+		}
+	}
+}
+
+//---------------------------------------------------------------------------------
+// sendNACK requests the missing packets again, giving up with a key frame needed
+func (f *feedback) sendNACK() {
+	f.mu.Lock()
+	now := time.Now()
+	seqs := []uint16{}
+	for seq, s := range f.missing {
+		if s.sent >= nackRetries {
+			if now.Sub(s.last) > nackRetryAfter {
+				// not recovered, the frame is broken
+				delete(f.missing, seq)
+				f.needKey = true
+			}
+			continue
+		}
+		if s.sent == 0 || now.Sub(s.last) > nackRetryAfter {
+			s.sent++
+			s.last = now
+			seqs = append(seqs, seq)
+		}
+	}
+	ssrc, media, last := f.ssrc, f.mediaSSRC, f.lastSeq
+	f.mu.Unlock()
+	if len(seqs) == 0 {
+		return
+	}
+
+	// in order from the oldest for pairs of nack, over the wrap of sequence numbers
+	sort.Slice(seqs, func(i, j int) bool { return last-seqs[i] > last-seqs[j] })
+	err := f.pc.WriteRTCP([]rtcp.Packet{&rtcp.TransportLayerNack{
+		SenderSSRC: ssrc,
+		MediaSSRC:  media,
+		Nacks:      rtcp.NackPairsFromSequenceNumbers(seqs),
+	}})
+	if err != nil {
+		log.Println("feedback nack:", err)
+		return
+	}
+	f.pipeline.nackSent(len(seqs))
+}
+
+// sendPLI requests a key frame if needed, not more often than pliInterval
+func (f *feedback) sendPLI() {
+	f.mu.Lock()
+	if !f.needKey || time.Since(f.lastPLI) < pliInterval {
+		f.mu.Unlock()
+		return
+	}
+	f.lastPLI = time.Now()
+	f.mu.Unlock()
+
+	err := f.pli()
+	if err != nil {
+		log.Println("feedback pli:", err)
+	}
+}
+
+// sendReports sends the receiver report, with remb for video
+func (f *feedback) sendReports() {
+	report, ok := f.stats.receptionReport()
+	if !ok {
+		return
+	}
+
+	f.mu.Lock()
+	if !f.lastSRTime.IsZero() {
+		report.LastSenderReport = f.lastSR
+		report.Delay = uint32(time.Since(f.lastSRTime).Seconds() * 65536)
+	}
+	pkts := []rtcp.Packet{&rtcp.ReceiverReport{
+		SSRC:    f.ssrc,
+		Reports: []rtcp.ReceptionReport{report},
+	}}
+	if f.video {
+		f.updateEstimate(float64(report.FractionLost)/256, float64(f.stats.Bitrate()))
+		pkts = append(pkts, &rtcp.ReceiverEstimatedMaximumBitrate{
+			SenderSSRC: f.ssrc,
+			Bitrate:    float32(f.estimate),
+			SSRCs:      []uint32{report.SSRC},
+		})
+	}
+	f.mu.Unlock()
+
+	err := f.pc.WriteRTCP(pkts)
+	if err != nil {
+		log.Println("feedback report:", err)
+	}
+}
+
+// updateEstimate estimates the bandwidth by the loss as the sender side of gcc,
+// but not far above the rate received for the sender to ramp up gradually
+func (f *feedback) updateEstimate(loss, received float64) {
+	switch {
+	case loss > 0.1:
+		f.estimate *= 1 - 0.5*loss
+	case loss < 0.02:
+		f.estimate *= 1.08
+		max := 1.5 * received
+		if max < rembStartBitrate {
+			max = rembStartBitrate
+		}
+		if f.estimate > max {
+			f.estimate = max
+		}
+	}
+	if f.estimate < rembMinBitrate {
+		f.estimate = rembMinBitrate
+	}
+}
+
+//=================================================================================
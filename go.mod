@@ -3,9 +3,10 @@ module github.com/sikang99/spider-view
 go 1.17
 
 require (
-	github.com/gorilla/websocket v1.4.2 // indirect
-	github.com/pion/webrtc/v2 v2.2.26 // indirect
+	github.com/gorilla/websocket v1.4.2
+	github.com/pion/webrtc/v2 v2.2.26
 	gocv.io/x/gocv v0.28.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -21,7 +22,7 @@ require (
 	github.com/pion/quic v0.1.1 // indirect
 	github.com/pion/randutil v0.1.0 // indirect
 	github.com/pion/rtcp v1.2.8
-	github.com/pion/rtp v1.6.0 // indirect
+	github.com/pion/rtp v1.6.0
 	github.com/pion/sctp v1.7.10 // indirect
 	github.com/pion/sdp/v2 v2.4.0 // indirect
 	github.com/pion/srtp v1.5.1 // indirect
@@ -0,0 +1,210 @@
+//=================================================================================
+//	Filaname: grid.go
+// 	Function: multiple channels viewed in a tiled grid of a window
+// 	Author: Stoney Kang, sikang@teamgrit.kr
+// 	Copyright: TeamGRIT, 2021
+//=================================================================================
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+//---------------------------------------------------------------------------------
+// tile is a cell of the grid showing the last frame of a channel
+type tile struct {
+	sync.Mutex
+	img  gocv.Mat // last frame resized to the tile
+	size image.Point
+	rect image.Rectangle // position in the grid
+	prog *Program        // of the channel, for label and status
+}
+
+// update keeps the frame resized to the tile
+func (t *tile) update(img *gocv.Mat) {
+	t.Lock()
+	defer t.Unlock()
+	gocv.Resize(*img, &t.img, t.size, 0, 0, gocv.InterpolationArea)
+}
+
+// draw copies the last frame to the canvas with the label and status
+func (t *tile) draw(canvas *gocv.Mat) {
+	t.Lock()
+	if !t.img.Empty() {
+		region := canvas.Region(t.rect)
+		t.img.CopyTo(&region)
+		region.Close()
+	}
+	t.Unlock()
+
+	state, since := t.prog.State()
+	stateColor := color.RGBA{0, 255, 255, 0}
+	switch state {
+	case StateConnected:
+		stateColor = color.RGBA{0, 255, 0, 0}
+	case StateDisconnected, StateRejected:
+		stateColor = color.RGBA{0, 0, 255, 0}
+	}
+	if t.prog.LastMotion().Detected {
+		stateColor = color.RGBA{255, 0, 0, 0}
+	}
+
+	label := fmt.Sprintf("%s %s %s", t.prog.channel(), state, time.Since(since).Truncate(time.Second))
+	gocv.Rectangle(canvas, t.rect.Inset(1), stateColor, 2)
+	gocv.PutText(canvas, label, t.rect.Min.Add(image.Pt(10, t.size.Y-10)), gocv.FontHersheyPlain, 1.2, stateColor, 2)
+}
+
+//---------------------------------------------------------------------------------
+// grid composes the tiles of channels in a window of width x height
+type grid struct {
+	tiles  []*tile
+	canvas gocv.Mat
+}
+
+func newGrid(n, width, height int) *grid {
+	cols := int(math.Ceil(math.Sqrt(float64(n))))
+	rows := (n + cols - 1) / cols
+	size := image.Pt(width/cols, height/rows)
+
+	g := &grid{
+		canvas: gocv.NewMatWithSizeFromScalar(gocv.NewScalar(0, 0, 0, 0), rows*size.Y, cols*size.X, gocv.MatTypeCV8UC3),
+	}
+	for i := 0; i < n; i++ {
+		min := image.Pt(i%cols*size.X, i/cols*size.Y)
+		g.tiles = append(g.tiles, &tile{
+			img:  gocv.NewMat(),
+			size: size,
+			rect: image.Rectangle{Min: min, Max: min.Add(size)},
+		})
+	}
+	return g
+}
+
+func (g *grid) Close() {
+	for _, t := range g.tiles {
+		t.img.Close()
+	}
+	g.canvas.Close()
+}
+
+// render draws all tiles to the canvas
+func (g *grid) render() gocv.Mat {
+	g.canvas.SetTo(gocv.NewScalar(0, 0, 0, 0))
+	for _, t := range g.tiles {
+		t.draw(&g.canvas)
+	}
+	return g.canvas
+}
+
+//---------------------------------------------------------------------------------
+// runChannels subscribes the channels concurrently, each with its own session
+// and decoder, and shows them in a grid until ESC or signal
+func (d *Program) runChannels(channels []string) (err error) {
+	log.Println("i.runChannels:", channels)
+
+	var g *grid
+	if !d.Headless {
+		g = newGrid(len(channels), d.VideoWidth, d.VideoHeight)
+		defer g.Close()
+	}
+
+	var wg, detected sync.WaitGroup
+	children := []*Program{}
+	for i, id := range channels {
+		c, err := d.newChannel(id, i == 0)
+		if err != nil {
+			log.Println(id, err)
+			d.shutdown()
+			break
+		}
+		children = append(children, c)
+		d.mu.Lock()
+		d.children = append(d.children, c)
+		d.mu.Unlock()
+		if g != nil {
+			g.tiles[i].prog = c
+			c.tile = g.tiles[i]
+		}
+
+		wg.Add(1)
+		detected.Add(1)
+		go func() {
+			defer detected.Done()
+			c.detectMotion()
+		}()
+		go c.runThumbnails()
+		go func() {
+			defer wg.Done()
+			c.superviseSession()
+		}()
+	}
+
+	if g != nil {
+		d.showGrid(g)
+	}
+	wg.Wait()
+	d.shutdown()
+
+	// the closed decoders end the detection, before the tiles are freed
+	for _, c := range children {
+		c.closeMedia()
+	}
+	detected.Wait()
+	return
+}
+
+// newChannel returns a program of the channel with the same settings,
+// audio only for the first channel not to mix them
+func (d *Program) newChannel(id string, audio bool) (c *Program, err error) {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return
+	}
+	c = &Program{}
+	err = json.Unmarshal(data, c)
+	if err != nil {
+		return
+	}
+
+	c.ChannelID = id
+	c.urlTemplate = d.urlTemplate
+	c.URL = d.channelURL(id)
+	c.Channels = ""
+	if !audio {
+		c.AudioOutput = ""
+	}
+	c.ctx, c.cancel = d.ctx, d.cancel
+	c.events = d.events
+	c.clock = newMediaClock()
+	c.setState(StateConnecting)
+
+	err = c.openMedia()
+	return
+}
+
+// showGrid shows the grid in a window until ESC or signal, 's' saves the snapshots
+func (d *Program) showGrid(g *grid) {
+	window := gocv.NewWindow("Spider Video Viewer")
+	defer window.Close()
+
+	for !d.quitting() {
+		window.IMShow(g.render())
+		switch window.WaitKey(40) {
+		case 27: // ESC
+			d.shutdown()
+		case 's':
+			d.saveSnapshots()
+		}
+	}
+}
+
+//=================================================================================
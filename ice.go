@@ -0,0 +1,113 @@
+//=================================================================================
+//	Filaname: ice.go
+// 	Function: ice servers and their credentials
+// 	Author: Stoney Kang, sikang@teamgrit.kr
+// 	Copyright: TeamGRIT, 2021
+//=================================================================================
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v2"
+)
+
+//---------------------------------------------------------------------------------
+const (
+	ICEPolicyAll   = "all"
+	ICEPolicyRelay = "relay"
+
+	iceFetchTimeout = 3 * time.Second
+	turnDefaultTTL  = 24 * 60 * 60 // sec
+)
+
+// ICEServerConfig is an ice server with its credential. If Secret is given,
+// a time-limited credential of the TURN REST API is made from it.
+type ICEServerConfig struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+	Secret     string   `json:"secret,omitempty"` // shared secret with the turn server
+	TTL        int      `json:"ttl,omitempty"`    // lifetime of the REST credential in sec
+}
+
+//---------------------------------------------------------------------------------
+// toWebRTC returns the server with its credential for a peer connection
+func (s ICEServerConfig) toWebRTC() (server webrtc.ICEServer) {
+	server = webrtc.ICEServer{
+		URLs:       s.URLs,
+		Username:   s.Username,
+		Credential: s.Credential,
+	}
+	if s.Secret != "" {
+		ttl := s.TTL
+		if ttl <= 0 {
+			ttl = turnDefaultTTL
+		}
+		server.Username, server.Credential = turnRESTCredential(s.Secret, s.Username, time.Duration(ttl)*time.Second)
+		server.CredentialType = webrtc.ICECredentialTypePassword
+	}
+	return
+}
+
+// turnRESTCredential makes a credential valid until now + ttl, by the TURN REST API
+// https://datatracker.ietf.org/doc/html/draft-uberti-behave-turn-rest-00
+func turnRESTCredential(secret, user string, ttl time.Duration) (username, credential string) {
+	username = fmt.Sprint(time.Now().Add(ttl).Unix())
+	if user != "" {
+		username += ":" + user
+	}
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	credential = base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	return
+}
+
+//---------------------------------------------------------------------------------
+// iceServers returns the servers fetched from the spider server if any, or else
+// the configured servers with the stun/turn of the -ice host
+func (d *Program) iceServers(fetched []ICEServerConfig) (servers []webrtc.ICEServer) {
+	configs := fetched
+	if len(configs) == 0 {
+		configs = append(configs, d.ICEServers...)
+		if d.ICEServer != "" {
+			configs = append(configs, ICEServerConfig{URLs: []string{"stun:" + d.ICEServer}})
+			if d.ICEUser != "" || d.ICESecret != "" {
+				configs = append(configs, ICEServerConfig{
+					URLs: []string{
+						"turn:" + d.ICEServer + "?transport=udp",
+						"turn:" + d.ICEServer + "?transport=tcp",
+					},
+					Username:   d.ICEUser,
+					Credential: d.ICEPass,
+					Secret:     d.ICESecret,
+				})
+			}
+		}
+	}
+
+	for _, c := range configs {
+		servers = append(servers, c.toWebRTC())
+	}
+	return
+}
+
+// iceTransportPolicy returns the policy of candidates to use
+func (d *Program) iceTransportPolicy() (policy webrtc.ICETransportPolicy, err error) {
+	switch strings.ToLower(d.ICEPolicy) {
+	case "", ICEPolicyAll:
+		policy = webrtc.ICETransportPolicyAll
+	case ICEPolicyRelay:
+		policy = webrtc.ICETransportPolicyRelay
+	default:
+		err = fmt.Errorf("unknown ice policy: %s", d.ICEPolicy)
+	}
+	return
+}
+
+//=================================================================================
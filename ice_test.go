@@ -0,0 +1,113 @@
+//=================================================================================
+//	Filaname: ice_test.go
+// 	Function: tests of ice servers and their credentials
+// 	Author: Stoney Kang, sikang@teamgrit.kr
+// 	Copyright: TeamGRIT, 2021
+//=================================================================================
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v2"
+)
+
+//---------------------------------------------------------------------------------
+func TestTurnRESTCredential(t *testing.T) {
+	tests := []struct {
+		name   string
+		secret string
+		user   string
+		ttl    time.Duration
+	}{
+		{"no user", "secret", "", time.Hour},
+		{"user", "secret", "alice", time.Hour},
+		{"other secret", "another", "alice", 24 * time.Hour},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expiry := time.Now().Add(tt.ttl).Unix()
+			username, credential := turnRESTCredential(tt.secret, tt.user, tt.ttl)
+
+			parts := strings.SplitN(username, ":", 2)
+			at, err := strconv.ParseInt(parts[0], 10, 64)
+			if err != nil || at < expiry || at > expiry+1 {
+				t.Errorf("username %s, want expiry %d", username, expiry)
+			}
+			if user := strings.TrimPrefix(username, parts[0]+":"); tt.user != "" && user != tt.user {
+				t.Errorf("username %s, want user %s", username, tt.user)
+			}
+			if tt.user == "" && len(parts) != 1 {
+				t.Errorf("username %s, want no user", username)
+			}
+
+			mac := hmac.New(sha1.New, []byte(tt.secret))
+			mac.Write([]byte(username))
+			if want := base64.StdEncoding.EncodeToString(mac.Sum(nil)); credential != want {
+				t.Errorf("credential %s, want %s", credential, want)
+			}
+		})
+	}
+}
+
+func TestICEServers(t *testing.T) {
+	configured := ICEServerConfig{URLs: []string{"turns:turn.example.com:443"}, Username: "u", Credential: "c"}
+	turn := []string{"turn:ice.example.com?transport=udp", "turn:ice.example.com?transport=tcp"}
+	stun := func(url string) webrtc.ICEServer {
+		return webrtc.ICEServer{URLs: []string{url}, Credential: ""}
+	}
+
+	tests := []struct {
+		name    string
+		d       *Program
+		fetched []ICEServerConfig
+		want    []webrtc.ICEServer
+	}{
+		{"none", &Program{}, nil, nil},
+		{"stun of ice host", &Program{ICEServer: "ice.example.com"}, nil,
+			[]webrtc.ICEServer{stun("stun:ice.example.com")}},
+		{"turn of ice host", &Program{ICEServer: "ice.example.com", ICEUser: "u", ICEPass: "p"}, nil,
+			[]webrtc.ICEServer{stun("stun:ice.example.com"), {URLs: turn, Username: "u", Credential: "p"}}},
+		{"configured first", &Program{ICEServer: "ice.example.com", ICEServers: []ICEServerConfig{configured}}, nil,
+			[]webrtc.ICEServer{{URLs: configured.URLs, Username: "u", Credential: "c"}, stun("stun:ice.example.com")}},
+		{"fetched only", &Program{ICEServer: "ice.example.com", ICEServers: []ICEServerConfig{configured}},
+			[]ICEServerConfig{{URLs: []string{"stun:fetched.example.com"}}},
+			[]webrtc.ICEServer{stun("stun:fetched.example.com")}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if servers := tt.d.iceServers(tt.fetched); !reflect.DeepEqual(servers, tt.want) {
+				t.Errorf("iceServers = %+v, want %+v", servers, tt.want)
+			}
+		})
+	}
+}
+
+func TestICEServersSecret(t *testing.T) {
+	d := &Program{ICEServer: "ice.example.com", ICEUser: "alice", ICESecret: "secret"}
+	servers := d.iceServers(nil)
+	if len(servers) != 2 {
+		t.Fatalf("iceServers = %+v, want stun and turn", servers)
+	}
+
+	turn := servers[1]
+	if !strings.HasSuffix(turn.Username, ":alice") || turn.CredentialType != webrtc.ICECredentialTypePassword {
+		t.Errorf("turn %+v, want a rest credential of alice", turn)
+	}
+	mac := hmac.New(sha1.New, []byte("secret"))
+	mac.Write([]byte(turn.Username))
+	if want := base64.StdEncoding.EncodeToString(mac.Sum(nil)); turn.Credential != want {
+		t.Errorf("credential %v, want %s", turn.Credential, want)
+	}
+}
+
+//=================================================================================
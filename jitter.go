@@ -0,0 +1,165 @@
+//=================================================================================
+//	Filaname: jitter.go
+// 	Function: jitter buffer to reorder packets and reassemble frames before decoding
+// 	Author: Stoney Kang, sikang@teamgrit.kr
+// 	Copyright: TeamGRIT, 2021
+//=================================================================================
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+//---------------------------------------------------------------------------------
+// jitterStats counts the packets and frames handled by the jitter buffer
+type jitterStats struct {
+	sync.Mutex
+	late       uint64 // arrived after given up or emitted, including duplicates
+	lost       uint64 // given up after the latency
+	reordered  uint64 // arrived before a packet of smaller sequence number
+	incomplete uint64 // frames with packets lost
+	dropped    uint64 // frames dropped waiting for a key frame
+}
+
+// jitterBuffer keeps packets by the sequence number up to the latency to wait
+// for the missing ones, and emits whole frames in order. After a packet lost,
+// frames are dropped until the next key frame as the references are broken.
+// The packets are emitted only when a packet is pushed, as the stream goes on.
+type jitterBuffer struct {
+	latency  time.Duration
+	isKey    func(payload []byte) bool
+	stats    *jitterStats
+	lossFunc func() // called when a key frame is needed
+
+	packets map[uint16]bufferedPacket
+	ssrc    uint32
+	next    uint16 // sequence number to emit
+	highest uint16
+	started bool
+	waitKey bool
+	frame   []*rtp.Packet // of the current timestamp
+	dropTS  uint32        // of the last frame dropped
+}
+
+type bufferedPacket struct {
+	pkt     *rtp.Packet
+	arrival time.Time
+}
+
+func newJitterBuffer(latency time.Duration, isKey func([]byte) bool, stats *jitterStats, lossFunc func()) *jitterBuffer {
+	return &jitterBuffer{
+		latency:  latency,
+		isKey:    isKey,
+		stats:    stats,
+		lossFunc: lossFunc,
+		packets:  map[uint16]bufferedPacket{},
+		waitKey:  true,
+	}
+}
+
+// push adds a packet and returns the packets of frames completed in order
+func (j *jitterBuffer) push(pkt *rtp.Packet) (out []*rtp.Packet) {
+	if j.latency <= 0 {
+		return []*rtp.Packet{pkt}
+	}
+
+	j.stats.Lock()
+	defer j.stats.Unlock()
+
+	seq := pkt.SequenceNumber
+	if !j.started || pkt.SSRC != j.ssrc {
+		// a new stream
+		j.packets = map[uint16]bufferedPacket{}
+		j.frame = nil
+		j.ssrc, j.next, j.highest, j.started = pkt.SSRC, seq, seq, true
+	}
+
+	switch {
+	case seq-j.next >= 0x8000:
+		j.stats.late++
+		return j.pop(time.Now())
+	case seq-j.highest >= 0x8000:
+		j.stats.reordered++
+	default:
+		j.highest = seq
+	}
+	if _, ok := j.packets[seq]; ok {
+		j.stats.late++
+	} else {
+		j.packets[seq] = bufferedPacket{pkt: pkt, arrival: time.Now()}
+	}
+	return j.pop(time.Now())
+}
+
+// pop emits the frames completed, giving up the missing packets waited for the latency
+func (j *jitterBuffer) pop(now time.Time) (out []*rtp.Packet) {
+	for len(j.packets) > 0 {
+		b, ok := j.packets[j.next]
+		if !ok {
+			nearest, oldest := j.nearest()
+			if now.Sub(oldest) < j.latency {
+				return
+			}
+			// give up the missing packets before the nearest one
+			j.stats.lost += uint64(nearest - j.next)
+			j.next = nearest
+			if len(j.frame) > 0 {
+				j.stats.incomplete++
+				j.frame = nil
+			}
+			if !j.waitKey {
+				j.waitKey = true
+				if j.lossFunc != nil {
+					j.lossFunc()
+				}
+			}
+			continue
+		}
+		delete(j.packets, j.next)
+		j.next++
+		pkt := b.pkt
+
+		if len(j.frame) > 0 && pkt.Timestamp != j.frame[0].Timestamp {
+			// the marker of the frame is lost or not set, the frame ends here
+			out = append(out, j.frame...)
+			j.frame = nil
+		}
+		if j.waitKey {
+			if len(j.frame) == 0 && !j.isKey(pkt.Payload) {
+				if pkt.Timestamp != j.dropTS {
+					j.dropTS = pkt.Timestamp
+					j.stats.dropped++
+				}
+				continue
+			}
+			j.waitKey = false
+		}
+		j.frame = append(j.frame, pkt)
+		if pkt.Marker {
+			out = append(out, j.frame...)
+			j.frame = nil
+		}
+	}
+	return
+}
+
+// nearest returns the nearest sequence number buffered after the next one,
+// and the arrival time of the oldest packet
+func (j *jitterBuffer) nearest() (seq uint16, oldest time.Time) {
+	first := true
+	for s, b := range j.packets {
+		if first || s-j.next < seq-j.next {
+			seq = s
+		}
+		if first || b.arrival.Before(oldest) {
+			oldest = b.arrival
+		}
+		first = false
+	}
+	return
+}
+
+//=================================================================================
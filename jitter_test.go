@@ -0,0 +1,205 @@
+//=================================================================================
+//	Filaname: jitter_test.go
+// 	Function: tests of the jitter buffer
+// 	Author: Stoney Kang, sikang@teamgrit.kr
+// 	Copyright: TeamGRIT, 2021
+//=================================================================================
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+//---------------------------------------------------------------------------------
+// jitterStep pushes a packet, or gives up the missing packets if expire
+type jitterStep struct {
+	seq    uint16
+	ts     uint32
+	marker bool
+	key    bool
+	expire bool
+}
+
+// jitterCounts are the counts of jitterStats to compare
+type jitterCounts struct {
+	late, lost, reordered, incomplete, dropped uint64
+}
+
+func TestJitterBuffer(t *testing.T) {
+	const latency = 50 * time.Millisecond
+
+	tests := []struct {
+		name    string
+		latency time.Duration
+		steps   []jitterStep
+		out     []uint16 // sequence numbers emitted in order
+		counts  jitterCounts
+		losses  int // calls of lossFunc
+	}{
+		{
+			name:    "in order",
+			latency: latency,
+			steps: []jitterStep{
+				{seq: 1, ts: 100, key: true},
+				{seq: 2, ts: 100, marker: true},
+				{seq: 3, ts: 200, marker: true},
+			},
+			out: []uint16{1, 2, 3},
+		},
+		{
+			name:    "reordered",
+			latency: latency,
+			steps: []jitterStep{
+				{seq: 10, ts: 100, key: true},
+				{seq: 12, ts: 200, marker: true},
+				{seq: 11, ts: 100, marker: true},
+			},
+			out:    []uint16{10, 11, 12},
+			counts: jitterCounts{reordered: 1},
+		},
+		{
+			name:    "frame without marker ends at next timestamp",
+			latency: latency,
+			steps: []jitterStep{
+				{seq: 1, ts: 100, key: true},
+				{seq: 2, ts: 200, marker: true},
+			},
+			out: []uint16{1, 2},
+		},
+		{
+			name:    "sequence number wrapped",
+			latency: latency,
+			steps: []jitterStep{
+				{seq: 65535, ts: 100, key: true, marker: true},
+				{seq: 1, ts: 200, marker: true},
+				{seq: 0, ts: 150, marker: true},
+			},
+			out:    []uint16{65535, 0, 1},
+			counts: jitterCounts{reordered: 1},
+		},
+		{
+			name:    "duplicate is late",
+			latency: latency,
+			steps: []jitterStep{
+				{seq: 1, ts: 100, key: true, marker: true},
+				{seq: 1, ts: 100, key: true, marker: true},
+			},
+			out:    []uint16{1},
+			counts: jitterCounts{late: 1},
+		},
+		{
+			name:    "waiting for missing packet",
+			latency: latency,
+			steps: []jitterStep{
+				{seq: 1, ts: 100, key: true, marker: true},
+				{seq: 3, ts: 300, marker: true},
+			},
+			out: []uint16{1},
+		},
+		{
+			name:    "lost frame drops until key frame",
+			latency: latency,
+			steps: []jitterStep{
+				{seq: 1, ts: 100, key: true, marker: true},
+				{seq: 3, ts: 300, marker: true},
+				{expire: true},
+				{seq: 4, ts: 400, marker: true},
+				{seq: 5, ts: 500, key: true, marker: true},
+			},
+			out:    []uint16{1, 5},
+			counts: jitterCounts{lost: 1, dropped: 2},
+			losses: 1,
+		},
+		{
+			name:    "lost packet in frame",
+			latency: latency,
+			steps: []jitterStep{
+				{seq: 1, ts: 100, key: true},
+				{seq: 3, ts: 100, marker: true},
+				{expire: true},
+			},
+			counts: jitterCounts{lost: 1, incomplete: 1, dropped: 1},
+			losses: 1,
+		},
+		{
+			name:    "late after given up",
+			latency: latency,
+			steps: []jitterStep{
+				{seq: 1, ts: 100, key: true, marker: true},
+				{seq: 3, ts: 300, key: true, marker: true},
+				{expire: true},
+				{seq: 2, ts: 200, marker: true},
+			},
+			out:    []uint16{1, 3},
+			counts: jitterCounts{lost: 1, late: 1},
+			losses: 1,
+		},
+		{
+			name:    "frames dropped until first key frame",
+			latency: latency,
+			steps: []jitterStep{
+				{seq: 1, ts: 100},
+				{seq: 2, ts: 100, marker: true},
+				{seq: 3, ts: 200, key: true, marker: true},
+			},
+			out:    []uint16{3},
+			counts: jitterCounts{dropped: 1},
+		},
+		{
+			name: "disabled",
+			steps: []jitterStep{
+				{seq: 3, ts: 300, marker: true},
+				{seq: 1, ts: 100, marker: true},
+			},
+			out: []uint16{3, 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stats := &jitterStats{}
+			losses := 0
+			isKey := func(payload []byte) bool { return payload[0] == 1 }
+			j := newJitterBuffer(tt.latency, isKey, stats, func() { losses++ })
+
+			out := []uint16{}
+			for _, s := range tt.steps {
+				var pkts []*rtp.Packet
+				if s.expire {
+					stats.Lock()
+					pkts = j.pop(time.Now().Add(tt.latency))
+					stats.Unlock()
+				} else {
+					payload := []byte{0}
+					if s.key {
+						payload[0] = 1
+					}
+					pkts = j.push(&rtp.Packet{
+						Header:  rtp.Header{SSRC: 1, SequenceNumber: s.seq, Timestamp: s.ts, Marker: s.marker},
+						Payload: payload,
+					})
+				}
+				for _, p := range pkts {
+					out = append(out, p.SequenceNumber)
+				}
+			}
+
+			if !reflect.DeepEqual(out, append([]uint16{}, tt.out...)) {
+				t.Errorf("out = %v, want %v", out, tt.out)
+			}
+			counts := jitterCounts{stats.late, stats.lost, stats.reordered, stats.incomplete, stats.dropped}
+			if counts != tt.counts {
+				t.Errorf("counts = %+v, want %+v", counts, tt.counts)
+			}
+			if losses != tt.losses {
+				t.Errorf("losses = %d, want %d", losses, tt.losses)
+			}
+		})
+	}
+}
+
+//=================================================================================
@@ -7,70 +7,132 @@
 package main
 
 import (
-	"bufio"
-	"crypto/tls"
-	"encoding/json"
+	"context"
 	"flag"
 	"fmt"
-	"io"
 	"log"
+	"math/rand"
 	"net/http"
+	"net/url"
 	"os"
-	"os/exec"
-	"strconv"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"gocv.io/x/gocv"
 
-	"github.com/pion/rtcp"
 	"github.com/pion/webrtc/v2"
-	"github.com/pion/webrtc/v2/pkg/media/h264writer"
+	"github.com/sikang99/spider-view/signaling"
 )
 
 //---------------------------------------------------------------------------------
 const Version = "0.0.0.3"
 
-//---------------------------------------------------------------------------------
-type WsMessage struct {
-	Type string `json:"type"`
-	Data string `json:"data"`
-}
+// shutdownTimeout is the max time to close the sessions, decoders and recorders
+const shutdownTimeout = 5 * time.Second
 
+//---------------------------------------------------------------------------------
 type Program struct {
-	VideoWidth       int    `json:"video_width,omitempty"`
-	VideoHeight      int    `json:"video_height,omitempty"`
-	BitRate          int    `json:"bit_rate,omitempty"`
-	KeyFrameInterval int    `json:"key_frame_interval,omitempty"`
-	VideoNouse       bool   `json:"video_nouse,omitempty"`
-	AudioNouse       bool   `json:"audio_nouse,omitempty"`
-	VideoCodec       string `json:"video_codec,omitempty"`
-	AudioCodec       string `json:"audio_codec,omitempty"`
-	VideoType        string `json:"video_type,omitempty"`
-	AudioType        string `json:"audio_type,omitempty"`
-	VideoLabel       string `json:"video_label,omitempty"` // video device name (label)
-	AudioLabel       string `json:"audio_label,omitempty"` // audio device name (label)
-	ICEServer        string `json:"ice_server,omitempty"`
-	SpiderServer     string `json:"spider_server,omitempty"`
-	ChannelID        string `json:"channel_id,omitempty"`
-	URL              string `json:"url,omitempty"`
+	VideoWidth       int               `json:"video_width,omitempty"`
+	VideoHeight      int               `json:"video_height,omitempty"`
+	BitRate          int               `json:"bit_rate,omitempty"`
+	KeyFrameInterval int               `json:"key_frame_interval,omitempty"`
+	VideoNouse       bool              `json:"video_nouse,omitempty"`
+	AudioNouse       bool              `json:"audio_nouse,omitempty"`
+	VideoCodec       string            `json:"video_codec,omitempty"`
+	AudioCodec       string            `json:"audio_codec,omitempty"`
+	VideoType        string            `json:"video_type,omitempty"`
+	AudioType        string            `json:"audio_type,omitempty"`
+	VideoLabel       string            `json:"video_label,omitempty"` // video device name (label)
+	AudioLabel       string            `json:"audio_label,omitempty"` // audio device name (label)
+	ICEServer        string            `json:"ice_server,omitempty"`
+	ICEUser          string            `json:"ice_user,omitempty"`   // turn username of ice server
+	ICEPass          string            `json:"ice_pass,omitempty"`   // turn credential of ice server
+	ICESecret        string            `json:"ice_secret,omitempty"` // turn rest api secret of ice server
+	ICEPolicy        string            `json:"ice_policy,omitempty"` // all or relay
+	ICEFetch         bool              `json:"ice_fetch,omitempty"`  // get ice servers from spider server
+	ICEServers       []ICEServerConfig `json:"ice_servers,omitempty"`
+	SpiderServer     string            `json:"spider_server,omitempty"`
+	TLSCACert        string            `json:"tls_ca_cert,omitempty"`  // ca bundle to verify spider server
+	TLSCert          string            `json:"tls_cert,omitempty"`     // client certificate for mutual tls
+	TLSKey           string            `json:"tls_key,omitempty"`      // client key for mutual tls
+	TLSInsecure      bool              `json:"tls_insecure,omitempty"` // no verification of spider server
+	TLSPins          string            `json:"tls_pins,omitempty"`     // sha256 of spki in base64, comma separated
+	ChannelID        string            `json:"channel_id,omitempty"`
+	AuthToken        string            `json:"auth_token,omitempty"`      // bearer token to subscribe
+	AuthTokenFile    string            `json:"auth_token_file,omitempty"` // file of bearer token, read at every connection
+	AuthUser         string            `json:"auth_user,omitempty"`       // basic auth to subscribe
+	AuthPass         string            `json:"auth_pass,omitempty"`
+	SignSecret       string            `json:"sign_secret,omitempty"` // secret to sign the url with hmac
+	SignTTL          int               `json:"sign_ttl,omitempty"`    // lifetime of signed url in sec
+	URL              string            `json:"url,omitempty"`
+	Channels         string            `json:"channels,omitempty"`          // channel ids to view in a grid, comma separated
+	Signal           string            `json:"signal,omitempty"`            // spider, whep or manual, by url if empty
+	MotionMinArea    int               `json:"motion_min_area,omitempty"`   // minimum contour area to be motion
+	MotionThreshold  int               `json:"motion_threshold,omitempty"`  // threshold of foreground mask
+	MotionDilate     int               `json:"motion_dilate,omitempty"`     // size of dilation kernel
+	Zones            map[string][]Zone `json:"zones,omitempty"`             // zones of motion by channel id, * for the others
+	ReconnectMin     int               `json:"reconnect_min,omitempty"`     // min backoff to reconnect in msec
+	ReconnectMax     int               `json:"reconnect_max,omitempty"`     // max backoff to reconnect in msec
+	Record           bool              `json:"record,omitempty"`            // record the video to files
+	RecordDir        string            `json:"record_dir,omitempty"`        // directory of record files
+	RecordFormat     string            `json:"record_format,omitempty"`     // mp4 or mkv
+	RecordSegment    int               `json:"record_segment,omitempty"`    // max length of a segment in sec
+	RecordSize       int               `json:"record_size,omitempty"`       // max size of a segment in MB
+	RecordKeep       int               `json:"record_keep,omitempty"`       // number of segments to keep
+	Clip             bool              `json:"clip,omitempty"`              // record clips of motion
+	ClipDir          string            `json:"clip_dir,omitempty"`          // directory of clips
+	ClipPreRoll      int               `json:"clip_pre_roll,omitempty"`     // video kept before motion in sec
+	ClipHold         int               `json:"clip_hold,omitempty"`         // time without motion to end a clip in sec
+	AudioOutput      string            `json:"audio_output,omitempty"`      // pulse, alsa or .ogg file
+	AudioSyncMax     int               `json:"audio_sync_max,omitempty"`    // max wait of audio for video in msec
+	Decoder          string            `json:"decoder,omitempty"`           // video decoder to use
+	VideoScale       string            `json:"video_scale,omitempty"`       // native, fit or fixed to video size
+	JitterLatency    int               `json:"jitter_latency,omitempty"`    // max wait for missing packets in msec, 0 to disable
+	SnapshotDir      string            `json:"snapshot_dir,omitempty"`      // directory of snapshots and thumbnails
+	SnapshotFormat   string            `json:"snapshot_format,omitempty"`   // jpg or png
+	SnapshotInterval int               `json:"snapshot_interval,omitempty"` // period of thumbnails in sec, 0 to disable
+	Events           string            `json:"events,omitempty"`            // sinks of events, stdout, http(s) urls or files, comma separated
+	Headless         bool              `json:"headless,omitempty"`          // no window to display
+	HTTPAddr         string            `json:"http_addr,omitempty"`         // address of control api, none if empty
 	// -- Internal handling parts
-	ok bool
-	pc *webrtc.PeerConnection
+	ctx    context.Context // canceled by signal or ESC to end the sessions and exit
+	cancel context.CancelFunc
+	pc     *webrtc.PeerConnection
 	// ws     *websocket.Conn
-	msgch  chan WsMessage
-	ffmpeg struct {
-		cmd    *exec.Cmd
-		stdin  io.WriteCloser
-		stdout io.ReadCloser
-		stderr io.ReadCloser
-	} `json:"-"`
+	motion   motion
+	recorder *Recorder
+	clips    *ClipRecorder
+	events   *eventBus // shared by the channels
+	audio    AudioSink
+	clock    *mediaClock
+	decoder  Decoder
+	state    sessionState
+	tile     *tile        // of the grid, instead of the window
+	stats    receiveStats // of video
+	astats   receiveStats // of audio
+	pipeline pipelineStats
+	jstats   jitterStats
+	// -- Guarded by mu, changed by the control api
+	mu           sync.Mutex
+	children     []*Program // programs of channels in the grid
+	urlTemplate  string     // url with {channel} given by flag
+	iceState     string
+	videoSSRC    uint32
+	stopSession  func()
+	lastFrame    *Frame        // last frame copied for a snapshot
+	frameWaits   []chan *Frame // snapshots waiting for the next frame
+	restartsSent int           // restarts of the decoder sent in events
 }
 
 //---------------------------------------------------------------------------------
 func init() {
 	// runtime.LockOSThread()
 	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
+	rand.Seed(time.Now().UnixNano())
 }
 
 //---------------------------------------------------------------------------------
@@ -91,225 +153,342 @@ func main() {
 		VideoType:        "camera",
 		AudioType:        "microphone",
 		ICEServer:        "cobot.center:3478",
+		ICEPolicy:        ICEPolicyAll,
+		SignTTL:          60,
 		SpiderServer:     "localhost:8267",
 		ChannelID:        "bq5ame6g10l3jia3h0ng", // CoJam.Shop channel
-		ok:               true,
-		msgch:            make(chan WsMessage, 2),
+		MotionMinArea:    3000,
+		MotionThreshold:  25,
+		MotionDilate:     3,
+		ReconnectMin:     500,
+		ReconnectMax:     30_000,
+		RecordDir:        "record",
+		RecordFormat:     "mp4",
+		RecordSegment:    300,
+		ClipDir:          "clip",
+		ClipPreRoll:      5,
+		ClipHold:         5,
+		AudioSyncMax:     500,
+		Decoder:          "ffmpeg",
+		VideoScale:       ScaleNative,
+		JitterLatency:    int(nackWindow / time.Millisecond),
+		SnapshotDir:      "snapshot",
+		SnapshotFormat:   "jpg",
+		clock:            newMediaClock(),
 	}
 
-	// Handle command line options
+	// Handle command line options, over the config file and environment variables
+	configFile := ""
+	dumpConfig := false
+	flag.StringVar(&configFile, "config", configFile, "config file of settings in json or yaml")
+	flag.BoolVar(&dumpConfig, "dump-config", dumpConfig, "print the effective settings and exit")
 	flag.IntVar(&pg.BitRate, "brate", pg.BitRate, "bit rate of video to send in bps")
 	flag.IntVar(&pg.KeyFrameInterval, "kint", pg.KeyFrameInterval, "key frame interval")
+	flag.BoolVar(&pg.VideoNouse, "vnouse", pg.VideoNouse, "do not receive video")
+	flag.BoolVar(&pg.AudioNouse, "anouse", pg.AudioNouse, "do not receive audio")
+	flag.StringVar(&pg.VideoCodec, "vcodec", pg.VideoCodec, "video codec to receive [h264|vp8|vp9|av1]")
+	flag.StringVar(&pg.AudioCodec, "acodec", pg.AudioCodec, "audio codec to receive")
+	flag.StringVar(&pg.VideoType, "vtype", pg.VideoType, "type of video source [camera|screen]")
+	flag.StringVar(&pg.AudioType, "atype", pg.AudioType, "type of audio source")
+	flag.StringVar(&pg.VideoLabel, "vlabel", pg.VideoLabel, "video device name (label)")
+	flag.StringVar(&pg.AudioLabel, "alabel", pg.AudioLabel, "audio device name (label)")
 	flag.StringVar(&pg.ICEServer, "ice", pg.ICEServer, "ice server address to use")
-	flag.StringVar(&pg.SpiderServer, "spider", pg.SpiderServer, "ice server address to use")
+	flag.StringVar(&pg.ICEUser, "ice-user", pg.ICEUser, "turn username of ice server")
+	flag.StringVar(&pg.ICEPass, "ice-pass", pg.ICEPass, "turn credential of ice server")
+	flag.StringVar(&pg.ICESecret, "ice-secret", pg.ICESecret, "turn rest api secret of ice server to make credential")
+	flag.StringVar(&pg.ICEPolicy, "ice-policy", pg.ICEPolicy, "ice transport policy [all|relay]")
+	flag.BoolVar(&pg.ICEFetch, "ice-fetch", pg.ICEFetch, "get ice servers from spider server")
+	flag.StringVar(&pg.SpiderServer, "spider", pg.SpiderServer, "spider server address to use")
+	flag.StringVar(&pg.TLSCACert, "cacert", pg.TLSCACert, "ca bundle file to verify spider server")
+	flag.StringVar(&pg.TLSCert, "cert", pg.TLSCert, "client certificate file for mutual tls")
+	flag.StringVar(&pg.TLSKey, "key", pg.TLSKey, "client key file for mutual tls")
+	flag.BoolVar(&pg.TLSInsecure, "insecure", pg.TLSInsecure, "do not verify certificate of spider server")
+	flag.StringVar(&pg.TLSPins, "pin", pg.TLSPins, "base64 sha256 hashes of spki to pin spider server, comma separated")
 	flag.StringVar(&pg.ChannelID, "channel", pg.ChannelID, "channel id of spider server to send")
-	flag.StringVar(&pg.URL, "url", pg.URL, "url of spider server to connect")
+	flag.StringVar(&pg.Channels, "channels", pg.Channels, "channel ids to view in a grid, comma separated")
+	flag.StringVar(&pg.URL, "url", pg.URL, "url of spider server (ws/wss) or whep endpoint (http/https), {channel} replaced by channel id")
+	flag.StringVar(&pg.Signal, "signal", pg.Signal, "signaling to use [spider|whep|manual], by url if empty")
+	flag.StringVar(&pg.AuthToken, "token", pg.AuthToken, "bearer token to subscribe the channel")
+	flag.StringVar(&pg.AuthTokenFile, "token-file", pg.AuthTokenFile, "file of bearer token, read again at reconnection")
+	flag.StringVar(&pg.AuthUser, "user", pg.AuthUser, "username of basic auth to subscribe the channel")
+	flag.StringVar(&pg.AuthPass, "pass", pg.AuthPass, "password of basic auth to subscribe the channel")
+	flag.StringVar(&pg.SignSecret, "sign-secret", pg.SignSecret, "secret to sign the url with hmac")
+	flag.IntVar(&pg.SignTTL, "sign-ttl", pg.SignTTL, "lifetime of the signed url in sec")
+	flag.IntVar(&pg.MotionMinArea, "marea", pg.MotionMinArea, "minimum area of motion to detect")
+	flag.IntVar(&pg.MotionThreshold, "mthresh", pg.MotionThreshold, "threshold of foreground mask for motion")
+	flag.IntVar(&pg.MotionDilate, "mdilate", pg.MotionDilate, "kernel size of dilation for motion")
+	flag.IntVar(&pg.ReconnectMin, "bmin", pg.ReconnectMin, "min backoff to reconnect in msec")
+	flag.IntVar(&pg.ReconnectMax, "bmax", pg.ReconnectMax, "max backoff to reconnect in msec")
+	flag.BoolVar(&pg.Record, "record", pg.Record, "record the video to files")
+	flag.StringVar(&pg.RecordDir, "rdir", pg.RecordDir, "directory of record files")
+	flag.StringVar(&pg.RecordFormat, "rformat", pg.RecordFormat, "format of record files [mp4|mkv]")
+	flag.IntVar(&pg.RecordSegment, "rsegment", pg.RecordSegment, "max length of a record segment in sec, 0 for no limit")
+	flag.IntVar(&pg.RecordSize, "rsize", pg.RecordSize, "max size of a record segment in MB, 0 for no limit")
+	flag.IntVar(&pg.RecordKeep, "rkeep", pg.RecordKeep, "number of record segments to keep, 0 for all")
+	flag.BoolVar(&pg.Clip, "clip", pg.Clip, "record clips of motion, in the format of record files")
+	flag.StringVar(&pg.ClipDir, "cdir", pg.ClipDir, "directory of clips")
+	flag.IntVar(&pg.ClipPreRoll, "cpre", pg.ClipPreRoll, "video kept before motion in a clip in sec")
+	flag.IntVar(&pg.ClipHold, "chold", pg.ClipHold, "time without motion to end a clip in sec")
+	flag.StringVar(&pg.AudioOutput, "aout", pg.AudioOutput, "output of audio [pulse|alsa|file.ogg], none if empty")
+	flag.IntVar(&pg.AudioSyncMax, "async", pg.AudioSyncMax, "max wait of audio to sync with video in msec, 0 to disable")
+	flag.StringVar(&pg.Decoder, "decoder", pg.Decoder, "video decoder to use [ffmpeg]")
+	flag.StringVar(&pg.VideoScale, "scale", pg.VideoScale, "scale of video to display [native|fit|fixed] to width x height")
+	flag.IntVar(&pg.JitterLatency, "jitter", pg.JitterLatency, "max wait for missing packets in msec, 0 to disable the jitter buffer")
+	flag.StringVar(&pg.SnapshotDir, "sdir", pg.SnapshotDir, "directory of snapshots and thumbnails")
+	flag.StringVar(&pg.SnapshotFormat, "sformat", pg.SnapshotFormat, "format of snapshots and thumbnails [jpg|png]")
+	flag.IntVar(&pg.SnapshotInterval, "sinterval", pg.SnapshotInterval, "period to overwrite the thumbnail of each channel in sec, 0 to disable")
+	flag.StringVar(&pg.Events, "events", pg.Events, "sinks of events [stdout|http(s) webhook url|json-lines file], comma separated")
+	flag.BoolVar(&pg.Headless, "headless", pg.Headless, "run without window, for servers and tests")
+	flag.StringVar(&pg.HTTPAddr, "http", pg.HTTPAddr, "address of control api to listen, ex. localhost:8280")
+	flag.IntVar(&pg.VideoWidth, "width", pg.VideoWidth, "width of video to fit or fix")
+	flag.IntVar(&pg.VideoHeight, "height", pg.VideoHeight, "height of video to fit or fix")
 	flag.Parse()
 
-	if pg.URL == "" {
-		pg.URL = fmt.Sprintf("wss://%s/live/ws/sub?channel=%s&vcodec=%s",
-			pg.SpiderServer, pg.ChannelID, pg.VideoCodec)
-	}
-
-	err := pg.openFFmpeg()
+	err := pg.configure(configFile)
 	if err != nil {
 		log.Println(err)
 		return
 	}
-	defer pg.closeFFmpeg()
-
-	ws, err := pg.connectWebsocketByUrl(pg.URL, 1024)
+	err = checkZones(pg.Zones)
 	if err != nil {
 		log.Println(err)
 		return
 	}
-	defer ws.Close()
-
-	rtcConfig := pg.setRTCConfiguratrion()
 
-	me := webrtc.MediaEngine{}
-	me.RegisterDefaultCodecs()
-
-	api := webrtc.NewAPI(webrtc.WithMediaEngine(me))
-	pg.pc, err = api.NewPeerConnection(rtcConfig)
-	if err != nil {
-		log.Println(err)
-		return
+	channels := splitList(pg.Channels)
+	pg.urlTemplate = pg.URL
+	if len(channels) == 0 {
+		pg.URL = pg.channelURL(pg.ChannelID)
 	}
 
-	h264Writer := h264writer.NewWith(pg.ffmpeg.stdin)
-	if err != nil {
-		log.Println(err)
+	if dumpConfig {
+		pg.dumpConfig()
 		return
 	}
-	log.Println(h264Writer)
 
-	pg.pc.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
-		log.Println("w.OnICEConnectionState:", connectionState)
-		if connectionState == webrtc.ICEConnectionStateDisconnected {
-			os.Exit(0)
-		}
-	})
-
-	pg.pc.OnICECandidate(func(iceCandidate *webrtc.ICECandidate) {
-		log.Println("w.OnICECandidate:", iceCandidate)
-		if iceCandidate != nil {
-			candidate := iceCandidate.ToJSON()
-			data, err := json.Marshal(candidate)
-			if err != nil {
-				log.Println("json.Marshal", err)
-				return
-			}
-			pg.msgch <- WsMessage{
-				Type: "send-candidate2",
-				Data: string(data),
-			}
-		}
-	})
+	// end the sessions properly by signal, ex. delete of the whep session
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	pg.ctx, pg.cancel = context.WithCancel(ctx)
+	defer pg.cancel()
+	go pg.limitShutdown(stop)
+	go pg.snapshotBySignal()
 
-	pg.pc.OnTrack(func(track *webrtc.Track, receiver *webrtc.RTPReceiver) {
-		log.Println("w.OnTrack:", track.ID(), track.PayloadType(), track.Codec().RTPCodecCapability.MimeType)
-		if track.Kind() != webrtc.RTPCodecTypeVideo {
-			log.Println("ignore>", track.Kind(), "track:", track.ID())
+	if pg.Events != "" {
+		pg.events, err = newEventBus(splitList(pg.Events))
+		if err != nil {
+			log.Println(err)
 			return
 		}
-		go func() {
-			ticker := time.NewTicker(time.Second * 3)
-			for range ticker.C {
-				err := pg.pc.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(track.SSRC())}})
-				if err != nil {
-					log.Println(err)
-					return
-				}
-			}
-		}()
-
-		for pg.ok {
-			rtp, err := track.ReadRTP()
-			if err != nil {
-				log.Println(err)
-				return
-			}
-
-			err = h264Writer.WriteRTP(rtp)
-			if err != nil {
-				log.Println(err)
-				return
-			}
-		}
-	})
-
-	pg.pc.OnDataChannel(func(dc *webrtc.DataChannel) {
-		log.Println("w.OnDataChannel:", dc.ID(), dc.Label())
-	})
+		defer pg.events.Close()
+	}
 
-	go pg.detectMotion()
+	if pg.HTTPAddr != "" {
+		go pg.serveControl()
+	}
 
-	err = pg.addRecvMediaTranceivers(true, true)
-	if err != nil {
-		log.Println(err)
+	if len(channels) > 0 {
+		pg.runChannels(channels)
 		return
 	}
 
-	go pg.procMessageByWebsocket(ws)
-	err = pg.sendOfferByWebsocket(ws)
+	err = pg.openMedia()
 	if err != nil {
 		log.Println(err)
 		return
 	}
+
+	go pg.runThumbnails()
+
+	detected := make(chan struct{})
+	go func() {
+		defer close(detected)
+		pg.detectMotion()
+	}()
+
+	pg.superviseSession()
+
+	// the session is closed, and then the decoder ends the detection
+	pg.shutdown()
+	pg.closeMedia()
+	<-detected
 }
 
 //---------------------------------------------------------------------------------
-func (d *Program) openFFmpeg() (err error) {
-	log.Println("i.openFFmpeg:", "bgr24")
-
-	d.ffmpeg.cmd = exec.Command("ffmpeg", "-i", "pipe:0", "-pix_fmt", "bgr24", "-s",
-		strconv.Itoa(d.VideoWidth)+"x"+strconv.Itoa(d.VideoHeight), "-f", "rawvideo", "pipe:1") //nolint
-	if d.ffmpeg.cmd == nil {
-		err = fmt.Errorf("ffmpeg exec error")
-		log.Println(err)
-		return
+// channelURL returns the url to subscribe a channel, {channel} in the url is replaced
+func (d *Program) channelURL(channel string) string {
+	if d.urlTemplate == "" {
+		return fmt.Sprintf("wss://%s/live/ws/sub?channel=%s&vcodec=%s",
+			d.SpiderServer, url.QueryEscape(channel), d.VideoCodec)
 	}
+	return strings.ReplaceAll(d.urlTemplate, "{channel}", url.QueryEscape(channel))
+}
 
-	d.ffmpeg.stdin, _ = d.ffmpeg.cmd.StdinPipe()
-	d.ffmpeg.stdout, _ = d.ffmpeg.cmd.StdoutPipe()
-	d.ffmpeg.stderr, err = d.ffmpeg.cmd.StderrPipe()
+// openMedia opens the decoder, and the recorders and audio sink if configured
+func (d *Program) openMedia() (err error) {
+	decoder, err := NewDecoder(d.Decoder, DecoderConfig{
+		Codec:  d.VideoCodec,
+		Scale:  d.VideoScale,
+		Width:  d.VideoWidth,
+		Height: d.VideoHeight,
+	})
 	if err != nil {
-		log.Println(err)
 		return
 	}
+	// the decoder and the recorders are set under the lock, read by the control api
+	channel := d.channel()
+	d.mu.Lock()
+	d.decoder = decoder
+	d.mu.Unlock()
+
+	if d.Record {
+		recorder, err := NewRecorder(d.RecordDir, channel, d.VideoCodec, d.RecordFormat,
+			time.Duration(d.RecordSegment)*time.Second, int64(d.RecordSize)<<20, d.RecordKeep)
+		if err != nil {
+			d.closeMedia()
+			return err
+		}
+		recorder.Saved = d.segmentSaved
+		d.mu.Lock()
+		d.recorder = recorder
+		d.mu.Unlock()
+	}
 
-	err = d.ffmpeg.cmd.Start()
-	if err != nil {
-		log.Println(err)
-		return
+	if d.Clip {
+		clips, err := NewClipRecorder(d.ClipDir, channel, d.VideoCodec, d.RecordFormat,
+			time.Duration(d.ClipPreRoll)*time.Second, time.Duration(d.ClipHold)*time.Second)
+		if err != nil {
+			d.closeMedia()
+			return err
+		}
+		clips.Saved = d.clipSaved
+		d.mu.Lock()
+		d.clips = clips
+		d.mu.Unlock()
+		d.OnMotion(clips.Motion)
 	}
 
-	go func() {
-		scanner := bufio.NewScanner(d.ffmpeg.stderr)
-		for scanner.Scan() {
-			log.Println(scanner.Text())
+	if d.events != nil {
+		d.OnMotion(d.motionEvents())
+	}
+
+	if d.AudioOutput != "" {
+		d.audio, err = NewAudioSink(d.AudioOutput)
+		if err != nil {
+			d.closeMedia()
+			return
 		}
-	}()
+	}
 	return
 }
 
-func (d *Program) closeFFmpeg() (err error) {
-	d.ffmpeg.cmd = nil
-	return
+// closeMedia closes what is opened by openMedia
+func (d *Program) closeMedia() {
+	if d.audio != nil {
+		d.audio.Close()
+	}
+	d.stopRecord()
+	if d.clips != nil {
+		d.clips.Close()
+	}
+	if d.decoder != nil {
+		d.decoder.Close()
+	}
+}
+
+// shutdown ends the sessions and the program
+func (d *Program) shutdown() {
+	d.cancel()
+}
+
+// quitting tells whether the program is shutting down
+func (d *Program) quitting() bool {
+	return d.ctx.Err() != nil
+}
+
+// limitShutdown exits the program if closing takes longer than shutdownTimeout,
+// or at once by another signal, as signals are not caught after the first
+func (d *Program) limitShutdown(stop func()) {
+	<-d.ctx.Done()
+	stop()
+	log.Println("shutting down in", shutdownTimeout)
+
+	time.AfterFunc(shutdownTimeout, func() {
+		log.Println("shutdown timeout, exit")
+		os.Exit(1)
+	})
 }
 
 //---------------------------------------------------------------------------------
 func (d *Program) detectMotion() (err error) {
-	log.Println("i.detectMotion")
+	log.Println("i.detectMotion:", "headless:", d.Headless)
 
 	// runtime.LockOSThread()
-	window := gocv.NewWindow("Spider Video Viewer")
-	defer window.Close()
+	var window *gocv.Window
+	if !d.Headless && d.tile == nil {
+		window = gocv.NewWindow("Spider Video Viewer")
+		defer window.Close()
+	}
 
-	img := gocv.NewMat()
-	defer img.Close()
+	channel := d.channel()
+	detector := newMotionDetector(d.MotionMinArea, d.MotionThreshold, d.MotionDilate, d.channelZones(channel))
+	defer detector.Close()
 
-	for d.ok {
-		buf := make([]byte, d.VideoWidth*d.VideoHeight*3)
-		_, err := io.ReadFull(d.ffmpeg.stdout, buf)
+	for !d.quitting() {
+		frame, err := d.decoder.ReadFrame()
 		if err != nil {
 			log.Println(err)
-			continue
+			return err
 		}
-		img, _ := gocv.NewMatFromBytes(d.VideoHeight, d.VideoWidth, gocv.MatTypeCV8UC3, buf)
-		if img.Empty() {
+		img, err := gocv.NewMatFromBytes(frame.Height, frame.Width, gocv.MatTypeCV8UC3, frame.Data)
+		if err != nil || img.Empty() {
+			img.Close()
 			continue
 		}
 
+		d.pipeline.frameDecoded()
+		d.setFrame(frame)
+		if c := d.channel(); c != channel {
+			// switched by the control api
+			channel = c
+			detector.zones.setZones(d.channelZones(c))
+		}
+		d.setMotion(detector.Detect(&img))
+
+		if d.tile != nil {
+			d.tile.update(&img)
+			d.pipeline.frameDisplayed()
+		}
+		if window == nil {
+			img.Close()
+			continue
+		}
 		window.IMShow(img)
-		if window.WaitKey(1) == 27 {
-			break
+		d.pipeline.frameDisplayed()
+		img.Close()
+		switch window.WaitKey(1) {
+		case 27: // ESC
+			d.shutdown()
+			return nil
+		case 's':
+			go d.saveSnapshots() // waits for the next frame of this loop
 		}
 	}
 	return
 }
 
 //---------------------------------------------------------------------------------
-func (d *Program) setRTCConfiguratrion() (rtcConfig webrtc.Configuration) {
-	log.Println("i.setRTCConfiguratrion:", d.ICEServer)
+func (d *Program) setRTCConfiguratrion(fetched []ICEServerConfig) (rtcConfig webrtc.Configuration, err error) {
+	log.Println("i.setRTCConfiguratrion:", d.ICEServer, "policy:", d.ICEPolicy, "fetched:", len(fetched))
+
+	policy, err := d.iceTransportPolicy()
+	if err != nil {
+		return
+	}
 
 	rtcConfig = webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{
-				//URLs: []string{"stun:stun.l.google.com:19302"},
-				URLs: []string{"stun:" + d.ICEServer},
-			},
-			{
-				URLs: []string{
-					"turn:" + d.ICEServer + "?transport=udp",
-					"turn:" + d.ICEServer + "?transport=tcp",
-				},
-				Username:   "teamgrit",
-				Credential: "teamgrit8266",
-			},
-		},
-		ICETransportPolicy: webrtc.ICETransportPolicyAll, // Policy[Relay|All]
+		ICEServers:         d.iceServers(fetched),
+		ICETransportPolicy: policy, // Policy[Relay|All]
 		PeerIdentity:       "spider-device",
 		SDPSemantics:       webrtc.SDPSemanticsUnifiedPlan,
 	}
@@ -341,15 +520,35 @@ func (d *Program) addRecvMediaTranceivers(faudio, fvideo bool) (err error) {
 func (d *Program) connectWebsocketByUrl(url string, bsize int) (ws *websocket.Conn, err error) {
 	log.Println("i.connectUrlByWebsocket:", url)
 
+	tlsConfig, err := d.tlsConfig()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	header, err := d.authHeader()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	url, err = d.signURL(url)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
 	var dialer = websocket.Dialer{
 		ReadBufferSize:  bsize,
 		WriteBufferSize: bsize,
 		Proxy:           http.ProxyFromEnvironment,
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		TLSClientConfig: tlsConfig,
 	}
 
-	ws, _, err = dialer.Dial(url, nil)
+	ws, resp, err := dialer.Dial(url, header)
 	if err != nil {
+		if aerr := authError(resp); aerr != nil {
+			err = aerr
+		}
 		log.Println(err)
 		return
 	}
@@ -357,9 +556,9 @@ func (d *Program) connectWebsocketByUrl(url string, bsize int) (ws *websocket.Co
 }
 
 //---------------------------------------------------------------------------------
-func (d *Program) sendOfferByWebsocket(ws *websocket.Conn) (err error) {
-	log.Println("i.sendOfferByWebsocket")
-	defer log.Println("o.sendOfferByWebsocket", err)
+// sendOffer sends the offer, with all candidates if the signaler does not trickle
+func (d *Program) sendOffer(sig Signaler, gathered, done chan struct{}) (err error) {
+	log.Println("i.sendOffer")
 
 	offer, err := d.pc.CreateOffer(nil)
 	if err != nil {
@@ -373,120 +572,94 @@ func (d *Program) sendOfferByWebsocket(ws *websocket.Conn) (err error) {
 		return
 	}
 
-	d.msgch <- WsMessage{
-		Type: "send-offer",
-		Data: offer.SDP,
-	}
-
-	for d.ok {
-		rmsg := WsMessage{}
-		err = ws.ReadJSON(&rmsg)
-		if err != nil {
-			log.Println(err)
+	if !sig.Trickle() {
+		select {
+		case <-gathered:
+		case <-done:
 			return
 		}
-		d.msgch <- rmsg
+		offer = *d.pc.LocalDescription()
+	}
+
+	err = sig.Send(signaling.Offer{SDP: offer.SDP})
+	if err != nil {
+		log.Println(err)
 	}
 	return
 }
 
 //---------------------------------------------------------------------------------
-func (d *Program) procMessageByWebsocket(ws *websocket.Conn) (err error) {
-	log.Println("i.procMessageByWebsocket")
-	defer log.Println("o.ProcMessageByWebsocket", err)
+func (d *Program) procSignaling(sig Signaler, done chan struct{}) (err error) {
+	log.Println("i.procSignaling")
+	defer log.Println("o.procSignaling", err)
 
-	ticker := time.NewTicker(30 * time.Second)
-	defer ticker.Stop()
-
-	for d.ok {
+	for !d.quitting() {
 		select {
-		case <-ticker.C:
-			ws.WriteJSON(&WsMessage{
-				Type: "ping",
-			})
-		case m, ok := <-d.msgch:
+		case <-done:
+			return
+		case m, ok := <-sig.Recv():
 			if !ok {
-				err = fmt.Errorf("msgch recv error")
+				err = fmt.Errorf("signaling closed")
 				log.Println(err)
 				return
 			}
-			// log.Println(m.Type)
-			switch m.Type {
-			case "ping", "pong", "joins":
-				log.Println("[msg]", m)
-			case "offer":
-				offer := webrtc.SessionDescription{
-					Type: webrtc.SDPTypeOffer,
-					SDP:  m.Data,
-				}
-				err = d.pc.SetRemoteDescription(offer)
-				if err != nil {
-					log.Println("pc.SetRemoteDescription", err)
-					return
-				}
-				answer, err := d.pc.CreateAnswer(nil)
-				if err != nil {
-					log.Println(err)
-					return err
-				}
-				err = d.pc.SetLocalDescription(answer)
-				if err != nil {
-					log.Println("pc.SetLocalDescription", err)
-					return err
-				}
-				ws.WriteJSON(&WsMessage{
-					Type: "answer",
-					Data: answer.SDP,
-				})
-			case "answer":
-				answer := webrtc.SessionDescription{
-					Type: webrtc.SDPTypeAnswer,
-					SDP:  m.Data,
-				}
-				err = d.pc.SetRemoteDescription(answer)
-				if err != nil {
-					log.Println("pc.SetRemoteDescription", err)
-					return
-				}
-			case "candidate": // old style, pion/mediadevices
-				// log.Println("msg.data", m.Data)
-				candidate := webrtc.ICECandidateInit{
-					Candidate: m.Data,
-				}
-				err = d.pc.AddICECandidate(candidate)
-				if err != nil {
-					log.Println("pc.AddICECandidate:", err)
-					return
-				}
-			case "candidate2": // new style, standard type
-				// log.Println("msg.data", m.Data)
-				candidate := webrtc.ICECandidateInit{}
-				err = json.Unmarshal([]byte(m.Data), &candidate)
-				if err != nil {
-					log.Println("json.Unmarshal:", err)
-					break
-				}
-				err = d.pc.AddICECandidate(candidate)
-				if err != nil {
-					log.Println("pc.AddICECandidate:", err)
-					return
-				}
-			case "send-offer":
-				ws.WriteJSON(&WsMessage{
-					Type: "offer",
-					Data: m.Data,
-				})
-			case "send-candidate2":
-				ws.WriteJSON(&WsMessage{
-					Type: "candidate2",
-					Data: m.Data,
-				})
-			default:
-				log.Println("unknown [msg]", m)
+			err = d.procMessage(sig, m)
+			if err != nil {
+				return
 			}
 		}
 	}
 	return
 }
 
+// procMessage handles a message from the remote peer
+func (d *Program) procMessage(sig Signaler, m signaling.Message) (err error) {
+	switch m := m.(type) {
+	case signaling.Offer:
+		offer := webrtc.SessionDescription{
+			Type: webrtc.SDPTypeOffer,
+			SDP:  m.SDP,
+		}
+		err = d.pc.SetRemoteDescription(offer)
+		if err != nil {
+			log.Println("pc.SetRemoteDescription", err)
+			return
+		}
+		answer, err := d.pc.CreateAnswer(nil)
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+		err = d.pc.SetLocalDescription(answer)
+		if err != nil {
+			log.Println("pc.SetLocalDescription", err)
+			return err
+		}
+		err = sig.Send(signaling.Answer{SDP: answer.SDP})
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+	case signaling.Answer:
+		answer := webrtc.SessionDescription{
+			Type: webrtc.SDPTypeAnswer,
+			SDP:  m.SDP,
+		}
+		err = d.pc.SetRemoteDescription(answer)
+		if err != nil {
+			log.Println("pc.SetRemoteDescription", err)
+			return
+		}
+	case signaling.Candidate: // candidate line (old style) or json (standard type)
+		err = d.pc.AddICECandidate(m.ICECandidateInit)
+		if err != nil {
+			log.Println("pc.AddICECandidate:", err)
+			return
+		}
+	default:
+		log.Println("unexpected [msg]", signaling.String(m))
+	}
+	return
+}
+
 //=================================================================================
@@ -0,0 +1,158 @@
+//=================================================================================
+//	Filaname: manual.go
+// 	Function: signaling by copy and paste of base64 sdp, as examples/signal
+// 	Author: Stoney Kang, sikang@teamgrit.kr
+// 	Copyright: TeamGRIT, 2021
+//=================================================================================
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/pion/webrtc/v2"
+	"github.com/sikang99/spider-view/signaling"
+)
+
+//---------------------------------------------------------------------------------
+// manualSignaler prints the offer in base64 and reads the answer from stdin
+type manualSignaler struct {
+	recv chan signaling.Message
+	done chan struct{}
+	once sync.Once
+}
+
+var (
+	stdinOnce  sync.Once
+	stdinLines chan string
+)
+
+// readStdin returns the lines of stdin, read by only one goroutine for all sessions
+func readStdin() <-chan string {
+	stdinOnce.Do(func() {
+		stdinLines = make(chan string)
+		go func() {
+			defer close(stdinLines)
+			scanner := bufio.NewScanner(os.Stdin)
+			scanner.Buffer(nil, 1<<20)
+			for scanner.Scan() {
+				line := strings.TrimSpace(scanner.Text())
+				if line != "" {
+					stdinLines <- line
+				}
+			}
+		}()
+	})
+	return stdinLines
+}
+
+func (s *manualSignaler) Open() (err error) {
+	s.recv = make(chan signaling.Message, 2)
+	s.done = make(chan struct{})
+	return
+}
+
+func (s *manualSignaler) Send(m signaling.Message) (err error) {
+	var desc webrtc.SessionDescription
+	switch m := m.(type) {
+	case signaling.Offer:
+		desc = webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: m.SDP}
+	case signaling.Answer:
+		desc = webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: m.SDP}
+	case signaling.Candidate:
+		// candidates are in the sdp
+		return
+	default:
+		log.Println("manual: ignore", m.Type())
+		return
+	}
+
+	data, err := encodeSDP(desc)
+	if err != nil {
+		return
+	}
+	fmt.Printf("\n%s in base64, paste it to the remote peer:\n\n%s\n\n", desc.Type, data)
+	fmt.Println("paste the reply of the remote peer in base64:")
+
+	go s.readReply()
+	return
+}
+
+func (s *manualSignaler) Recv() <-chan signaling.Message {
+	return s.recv
+}
+
+func (s *manualSignaler) Trickle() bool {
+	return false
+}
+
+func (s *manualSignaler) Close() error {
+	s.once.Do(func() {
+		close(s.done)
+	})
+	return nil
+}
+
+// readReply reads lines until a valid session description is pasted
+func (s *manualSignaler) readReply() {
+	for {
+		select {
+		case <-s.done:
+			return
+		case line, ok := <-readStdin():
+			if !ok {
+				log.Println("manual: stdin closed")
+				return
+			}
+			desc := webrtc.SessionDescription{}
+			err := decodeSDP(line, &desc)
+			if err != nil {
+				log.Println("manual:", err, "- paste again")
+				continue
+			}
+
+			var m signaling.Message
+			switch desc.Type {
+			case webrtc.SDPTypeOffer:
+				m = signaling.Offer{SDP: desc.SDP}
+			case webrtc.SDPTypeAnswer:
+				m = signaling.Answer{SDP: desc.SDP}
+			default:
+				log.Println("manual: unexpected", desc.Type, "- paste again")
+				continue
+			}
+			select {
+			case s.recv <- m:
+			case <-s.done:
+			}
+			return
+		}
+	}
+}
+
+//---------------------------------------------------------------------------------
+// encodeSDP encodes a session description in base64 json
+func encodeSDP(desc webrtc.SessionDescription) (string, error) {
+	data, err := json.Marshal(desc)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(data), nil
+}
+
+// decodeSDP decodes a session description from base64 json
+func decodeSDP(in string, desc *webrtc.SessionDescription) error {
+	data, err := base64.StdEncoding.DecodeString(in)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, desc)
+}
+
+//=================================================================================
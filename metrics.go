@@ -0,0 +1,221 @@
+//=================================================================================
+//	Filaname: metrics.go
+// 	Function: prometheus metrics of receive quality and pipeline health
+// 	Author: Stoney Kang, sikang@teamgrit.kr
+// 	Copyright: TeamGRIT, 2021
+//=================================================================================
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pion/webrtc/v2"
+)
+
+//---------------------------------------------------------------------------------
+const metricPrefix = "spider_view_"
+
+// iceStates are exported as a gauge per state, 1 for the current one
+var iceStates = []string{"new", "checking", "connected", "completed", "disconnected", "failed", "closed"}
+
+// restartCounter is a decoder counting its restarts
+type restartCounter interface {
+	Restarts() int
+}
+
+// metricWriter writes metrics in the text format of prometheus
+type metricWriter struct {
+	w *bufio.Writer
+}
+
+// family writes the help and type of a metric, before all its samples
+func (m *metricWriter) family(name, typ, help string) {
+	fmt.Fprintf(m.w, "# HELP %s%s %s\n# TYPE %s%s %s\n", metricPrefix, name, help, metricPrefix, name, typ)
+}
+
+// sample writes a value with labels given in pairs of name and value
+func (m *metricWriter) sample(name string, value float64, labels ...string) {
+	m.w.WriteString(metricPrefix + name)
+	if len(labels) > 0 {
+		pairs := []string{}
+		for i := 0; i+1 < len(labels); i += 2 {
+			pairs = append(pairs, labels[i]+"="+strconv.Quote(labels[i+1]))
+		}
+		m.w.WriteString("{" + strings.Join(pairs, ",") + "}")
+	}
+	m.w.WriteString(" " + strconv.FormatFloat(value, 'g', -1, 64) + "\n")
+}
+
+//---------------------------------------------------------------------------------
+// handleMetrics exports the metrics of all channels
+func (d *Program) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m := &metricWriter{w: bufio.NewWriter(w)}
+	defer m.w.Flush()
+
+	progs := d.programs()
+	channels := make([]string, len(progs))
+	for i, p := range progs {
+		channels[i] = p.channel()
+	}
+
+	m.family("rtp_packets_received_total", "counter", "RTP packets received.")
+	for i, p := range progs {
+		vp, _ := p.stats.Counts()
+		ap, _ := p.astats.Counts()
+		m.sample("rtp_packets_received_total", float64(vp), "channel", channels[i], "kind", "video")
+		m.sample("rtp_packets_received_total", float64(ap), "channel", channels[i], "kind", "audio")
+	}
+	m.family("rtp_bytes_received_total", "counter", "RTP bytes received.")
+	for i, p := range progs {
+		_, vb := p.stats.Counts()
+		_, ab := p.astats.Counts()
+		m.sample("rtp_bytes_received_total", float64(vb), "channel", channels[i], "kind", "video")
+		m.sample("rtp_bytes_received_total", float64(ab), "channel", channels[i], "kind", "audio")
+	}
+	m.family("rtp_packets_lost", "gauge", "RTP packets lost of the current stream.")
+	for i, p := range progs {
+		m.sample("rtp_packets_lost", float64(p.stats.Loss()), "channel", channels[i], "kind", "video")
+		m.sample("rtp_packets_lost", float64(p.astats.Loss()), "channel", channels[i], "kind", "audio")
+	}
+	m.family("rtp_jitter_seconds", "gauge", "Interarrival jitter of the current stream.")
+	for i, p := range progs {
+		m.sample("rtp_jitter_seconds", p.stats.Jitter().Seconds(), "channel", channels[i], "kind", "video")
+		m.sample("rtp_jitter_seconds", p.astats.Jitter().Seconds(), "channel", channels[i], "kind", "audio")
+	}
+
+	pipes := make([]pipelineStats, len(progs))
+	for i, p := range progs {
+		p.pipeline.Lock()
+		pipes[i] = pipelineStats{
+			decoded:   p.pipeline.decoded,
+			displayed: p.pipeline.displayed,
+			plis:      p.pipeline.plis,
+			nacks:     p.pipeline.nacks,
+			buckets:   append([]uint64(nil), p.pipeline.buckets...),
+			count:     p.pipeline.count,
+			sum:       p.pipeline.sum,
+		}
+		p.pipeline.Unlock()
+	}
+	m.family("rtcp_nacks_sent_total", "counter", "Packets requested again by RTCP NACK.")
+	for i := range progs {
+		m.sample("rtcp_nacks_sent_total", float64(pipes[i].nacks), "channel", channels[i])
+	}
+	m.family("rtcp_plis_sent_total", "counter", "Key frames requested by RTCP PLI.")
+	for i := range progs {
+		m.sample("rtcp_plis_sent_total", float64(pipes[i].plis), "channel", channels[i])
+	}
+	m.family("frames_decoded_total", "counter", "Frames read from the decoder.")
+	for i := range progs {
+		m.sample("frames_decoded_total", float64(pipes[i].decoded), "channel", channels[i])
+	}
+	m.family("frames_displayed_total", "counter", "Frames shown in the window or the grid.")
+	for i := range progs {
+		m.sample("frames_displayed_total", float64(pipes[i].displayed), "channel", channels[i])
+	}
+	m.family("decode_latency_seconds", "histogram", "Time from the last packet of a frame written to the decoder until decoded.")
+	for i := range progs {
+		for j, le := range latencyBuckets {
+			var n uint64
+			if j < len(pipes[i].buckets) {
+				n = pipes[i].buckets[j]
+			}
+			m.sample("decode_latency_seconds_bucket", float64(n), "channel", channels[i], "le", strconv.FormatFloat(le, 'g', -1, 64))
+		}
+		m.sample("decode_latency_seconds_bucket", float64(pipes[i].count), "channel", channels[i], "le", "+Inf")
+		m.sample("decode_latency_seconds_sum", pipes[i].sum, "channel", channels[i])
+		m.sample("decode_latency_seconds_count", float64(pipes[i].count), "channel", channels[i])
+	}
+	m.family("decoder_restarts_total", "counter", "Restarts of the decoder process.")
+	for i, p := range progs {
+		if rc, ok := p.getDecoder().(restartCounter); ok {
+			m.sample("decoder_restarts_total", float64(rc.Restarts()), "channel", channels[i])
+		}
+	}
+
+	m.family("jitter_packets_total", "counter", "Packets of the jitter buffer by event, late, lost or reordered.")
+	jstats := make([]jitterStats, len(progs))
+	for i, p := range progs {
+		p.jstats.Lock()
+		jstats[i] = jitterStats{
+			late:       p.jstats.late,
+			lost:       p.jstats.lost,
+			reordered:  p.jstats.reordered,
+			incomplete: p.jstats.incomplete,
+			dropped:    p.jstats.dropped,
+		}
+		p.jstats.Unlock()
+		m.sample("jitter_packets_total", float64(jstats[i].late), "channel", channels[i], "event", "late")
+		m.sample("jitter_packets_total", float64(jstats[i].lost), "channel", channels[i], "event", "lost")
+		m.sample("jitter_packets_total", float64(jstats[i].reordered), "channel", channels[i], "event", "reordered")
+	}
+	m.family("jitter_frames_total", "counter", "Frames of the jitter buffer by event, incomplete or dropped until a key frame.")
+	for i := range progs {
+		m.sample("jitter_frames_total", float64(jstats[i].incomplete), "channel", channels[i], "event", "incomplete")
+		m.sample("jitter_frames_total", float64(jstats[i].dropped), "channel", channels[i], "event", "dropped")
+	}
+
+	m.family("ice_state", "gauge", "ICE connection state, 1 for the current one.")
+	for i, p := range progs {
+		p.mu.Lock()
+		current := p.iceState
+		p.mu.Unlock()
+		for _, state := range iceStates {
+			value := 0.0
+			if state == current {
+				value = 1
+			}
+			m.sample("ice_state", value, "channel", channels[i], "state", state)
+		}
+	}
+	m.family("ice_candidate_pair", "gauge", "Types of the selected ICE candidate pair, 1 if connected.")
+	for i, p := range progs {
+		if local, remote, ok := p.candidatePair(); ok {
+			m.sample("ice_candidate_pair", 1, "channel", channels[i], "local", local, "remote", remote)
+		}
+	}
+}
+
+// candidatePair returns the types of the local and remote candidates nominated
+func (d *Program) candidatePair() (local, remote string, ok bool) {
+	d.mu.Lock()
+	pc, state := d.pc, d.iceState
+	d.mu.Unlock()
+	if pc == nil || (state != "connected" && state != "completed") {
+		return
+	}
+
+	report := pc.GetStats()
+	ids := []string{}
+	for id := range report {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var pair *webrtc.ICECandidatePairStats
+	for _, id := range ids {
+		if s, yes := report[id].(webrtc.ICECandidatePairStats); yes {
+			if s.Nominated || (pair == nil && s.State == webrtc.StatsICECandidatePairStateSucceeded) {
+				pair = &s
+			}
+		}
+	}
+	if pair == nil {
+		return
+	}
+	if s, yes := report[pair.LocalCandidateID].(webrtc.ICECandidateStats); yes {
+		local = s.CandidateType.String()
+	}
+	if s, yes := report[pair.RemoteCandidateID].(webrtc.ICECandidateStats); yes {
+		remote = s.CandidateType.String()
+	}
+	return local, remote, local != "" || remote != ""
+}
+
+//=================================================================================
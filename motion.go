@@ -0,0 +1,156 @@
+//=================================================================================
+//	Filaname: motion.go
+// 	Function: motion detection of decoded video frames
+// 	Author: Stoney Kang, sikang@teamgrit.kr
+// 	Copyright: TeamGRIT, 2021
+//=================================================================================
+package main
+
+import (
+	"image"
+	"image/color"
+	"log"
+	"sync"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+//---------------------------------------------------------------------------------
+const (
+	MotionStatusReady    = "Ready"
+	MotionStatusDetected = "Motion detected"
+)
+
+// MotionResult is the outcome of motion detection for a single frame
+type MotionResult struct {
+	Time     time.Time         `json:"time"`
+	Detected bool              `json:"detected"`
+	Status   string            `json:"status"`
+	Area     float64           `json:"area"`            // total area of all boxes over the minimum
+	Boxes    []image.Rectangle `json:"boxes,omitempty"` // bounding boxes of moving objects
+	Zones    []ZoneMotion      `json:"zones,omitempty"` // motion of include zones
+}
+
+// motionDetector is the MOG2 background subtraction pipeline taken from the GoCV examples
+// https://github.com/hybridgroup/gocv/blob/master/cmd/motion-detect/main.go
+type motionDetector struct {
+	minArea   float64
+	threshold float32
+	mog2      gocv.BackgroundSubtractorMOG2
+	kernel    gocv.Mat
+	imgDelta  gocv.Mat
+	imgThresh gocv.Mat
+	zones     *zoneMask
+}
+
+// motion keeps the last result and the consumers of motion results
+type motion struct {
+	sync.Mutex
+	last     MotionResult
+	handlers []func(MotionResult)
+}
+
+//---------------------------------------------------------------------------------
+func newMotionDetector(minArea, threshold, dilate int, zones []Zone) (m *motionDetector) {
+	log.Println("i.newMotionDetector:", "area:", minArea, "threshold:", threshold, "dilate:", dilate, "zones:", len(zones))
+
+	if dilate < 1 {
+		dilate = 1
+	}
+	m = &motionDetector{
+		minArea:   float64(minArea),
+		threshold: float32(threshold),
+		mog2:      gocv.NewBackgroundSubtractorMOG2(),
+		kernel:    gocv.GetStructuringElement(gocv.MorphRect, image.Pt(dilate, dilate)),
+		imgDelta:  gocv.NewMat(),
+		imgThresh: gocv.NewMat(),
+		zones:     newZoneMask(zones),
+	}
+	return
+}
+
+func (m *motionDetector) Close() {
+	m.mog2.Close()
+	m.kernel.Close()
+	m.imgDelta.Close()
+	m.imgThresh.Close()
+	m.zones.Close()
+}
+
+// Detect finds moving objects in img and draws the contours, boxes and status on it
+func (m *motionDetector) Detect(img *gocv.Mat) (res MotionResult) {
+	res = MotionResult{
+		Time:   time.Now(),
+		Status: MotionStatusReady,
+	}
+	statusColor := color.RGBA{0, 255, 0, 0}
+
+	// first phase of cleaning up image, obtain foreground only
+	m.mog2.Apply(*img, &m.imgDelta)
+
+	// remaining cleanup of the image to use for finding contours.
+	// first use threshold, then dilate
+	gocv.Threshold(m.imgDelta, &m.imgThresh, m.threshold, 255, gocv.ThresholdBinary)
+	gocv.Dilate(m.imgThresh, &m.imgThresh, m.kernel)
+
+	// only the foreground in the zones
+	m.zones.apply(&m.imgThresh)
+
+	// now find contours
+	contours := gocv.FindContours(m.imgThresh, gocv.RetrievalExternal, gocv.ChainApproxSimple)
+	defer contours.Close()
+
+	areas := []float64{}
+	for i := 0; i < contours.Size(); i++ {
+		area := gocv.ContourArea(contours.At(i))
+		if area < m.minArea {
+			continue
+		}
+
+		res.Detected = true
+		res.Status = MotionStatusDetected
+		res.Area += area
+		statusColor = color.RGBA{255, 0, 0, 0}
+		gocv.DrawContours(img, contours, i, statusColor, 2)
+
+		rect := gocv.BoundingRect(contours.At(i))
+		gocv.Rectangle(img, rect, color.RGBA{0, 0, 255, 0}, 2)
+		res.Boxes = append(res.Boxes, rect)
+		areas = append(areas, area)
+	}
+
+	res.Zones = m.zones.status(res.Boxes, areas)
+	m.zones.draw(img, res.Zones)
+
+	gocv.PutText(img, res.Status, image.Pt(10, 20), gocv.FontHersheyPlain, 1.2, statusColor, 2)
+	return
+}
+
+//---------------------------------------------------------------------------------
+// OnMotion sets a handler that is called with the motion result of every frame
+func (d *Program) OnMotion(f func(MotionResult)) {
+	d.motion.Lock()
+	defer d.motion.Unlock()
+	d.motion.handlers = append(d.motion.handlers, f)
+}
+
+// LastMotion returns the motion result of the last analyzed frame
+func (d *Program) LastMotion() MotionResult {
+	d.motion.Lock()
+	defer d.motion.Unlock()
+	return d.motion.last
+}
+
+func (d *Program) setMotion(res MotionResult) {
+	d.motion.Lock()
+	d.motion.last = res
+	handlers := d.motion.handlers
+	d.motion.Unlock()
+
+	for _, f := range handlers {
+		f(res)
+	}
+}
+
+//=================================================================================
@@ -0,0 +1,290 @@
+//=================================================================================
+//	Filaname: record.go
+// 	Function: recording of received video to segmented mp4/mkv files
+// 	Author: Stoney Kang, sikang@teamgrit.kr
+// 	Copyright: TeamGRIT, 2021
+//=================================================================================
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v2"
+)
+
+//---------------------------------------------------------------------------------
+// recordTime is the time in the names of records, in msec not to overwrite
+// a segment started in the same second
+const recordTime = "20060102-150405.000"
+
+// Recorder writes the received stream into segment files, each remuxed by ffmpeg
+// and started at a key frame, named by channel id and time of start
+type Recorder struct {
+	Dir     string
+	Channel string
+	Codec   string                        // video codec of the stream, h264, vp8, vp9 or av1
+	Format  string                        // mp4 (fragmented) or mkv
+	Segment time.Duration                 // max duration of a segment, 0 for no limit
+	MaxSize int64                         // max bytes of a segment, 0 for no limit
+	Keep    int                           // number of segments to keep, 0 for all
+	Saved   func(name string, size int64) // called when a segment is closed
+
+	mu      sync.Mutex
+	name    string
+	started time.Time
+	written int64
+	rotate  bool
+	writer  RTPWriter
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+}
+
+//---------------------------------------------------------------------------------
+func NewRecorder(dir, channel, codec, format string, segment time.Duration, maxSize int64, keep int) (r *Recorder, err error) {
+	log.Println("i.NewRecorder:", dir, channel, codec, format, segment, maxSize, keep)
+
+	err = checkRecordFormat(codec, format)
+	if err != nil {
+		return
+	}
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return
+	}
+
+	r = &Recorder{
+		Dir:     dir,
+		Channel: channel,
+		Codec:   codec,
+		Format:  format,
+		Segment: segment,
+		MaxSize: maxSize,
+		Keep:    keep,
+	}
+	return
+}
+
+// WriteRTP writes a H.264 packet, rotating the segment at a key frame if needed
+func (r *Recorder) WriteRTP(pkt *rtp.Packet) (err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.writer == nil || r.rotate || r.isFull() {
+		if !isKeyFrame(r.Codec, pkt.Payload) {
+			if r.writer == nil {
+				return // wait for the first key frame
+			}
+		} else {
+			r.closeSegment()
+			err = r.openSegment()
+			if err != nil {
+				return
+			}
+		}
+	}
+	return r.writer.WriteRTP(pkt)
+}
+
+// Rotate closes the current segment at the next key frame
+func (r *Recorder) Rotate() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rotate = true
+}
+
+func (r *Recorder) Close() (err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.closeSegment()
+}
+
+//---------------------------------------------------------------------------------
+func (r *Recorder) isFull() bool {
+	if r.Segment > 0 && time.Since(r.started) >= r.Segment {
+		return true
+	}
+	if r.MaxSize > 0 && r.written >= r.MaxSize {
+		return true
+	}
+	return false
+}
+
+func (r *Recorder) openSegment() (err error) {
+	r.started = time.Now()
+	r.name = filepath.Join(r.Dir, fmt.Sprintf("%s_%s.%s", r.Channel, r.started.Format(recordTime), r.Format))
+	log.Println("i.openSegment:", r.name)
+
+	r.written = 0
+	r.cmd, r.stdin, r.writer, err = startRemux(r.Codec, r.Format, r.name, false, &r.written)
+	if err != nil {
+		return
+	}
+	r.rotate = false
+
+	r.removeOldSegments()
+	return
+}
+
+func (r *Recorder) closeSegment() (err error) {
+	if r.cmd == nil {
+		return
+	}
+	log.Println("i.closeSegment:", r.name, r.written, "bytes")
+
+	r.stdin.Close()
+	err = r.cmd.Wait()
+	if err != nil {
+		log.Println(err)
+	}
+	r.cmd, r.stdin, r.writer = nil, nil, nil
+	if r.Saved != nil {
+		r.Saved(r.name, r.written)
+	}
+	return
+}
+
+// removeOldSegments keeps only the latest Keep segments of the channel, counting
+// the current one even before ffmpeg makes its file
+func (r *Recorder) removeOldSegments() {
+	if r.Keep <= 0 {
+		return
+	}
+	names, err := filepath.Glob(filepath.Join(r.Dir, r.Channel+"_*."+r.Format))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	old := []string{}
+	for _, name := range r.segmentsOf(names) {
+		if name != r.name {
+			old = append(old, name)
+		}
+	}
+	names = old
+	sort.Strings(names) // names are ordered by time
+	for len(names) > r.Keep-1 {
+		log.Println("remove segment:", names[0])
+		err = os.Remove(names[0])
+		if err != nil {
+			log.Println(err)
+		}
+		names = names[1:]
+	}
+}
+
+// segmentsOf returns the names of the segments of the channel, not of another
+// channel with the id starting by this one and _
+func (r *Recorder) segmentsOf(names []string) (segments []string) {
+	for _, name := range names {
+		t := strings.TrimPrefix(filepath.Base(name), r.Channel+"_")
+		t = strings.TrimSuffix(t, "."+r.Format)
+		if _, err := time.Parse(recordTime, t); err == nil {
+			segments = append(segments, name)
+		}
+	}
+	return
+}
+
+//---------------------------------------------------------------------------------
+// checkRecordFormat tells whether the codec can be recorded in the format
+func checkRecordFormat(codec, format string) (err error) {
+	if format != "mp4" && format != "mkv" {
+		return fmt.Errorf("unsupported record format: %s", format)
+	}
+	vc, err := lookupVideoCodec(codec)
+	if err != nil {
+		return
+	}
+	if vc.name == webrtc.VP8 && format == "mp4" {
+		return fmt.Errorf("vp8 can be recorded only in mkv")
+	}
+	return
+}
+
+// startRemux runs ffmpeg to copy the stream of the codec into the file of the format,
+// and returns the writer of rtp packets to it, counting the bytes written.
+// The frames are timed by the rtp timestamps in ivf if rtpTime, for the packets
+// written at once, or by the wall clock at arrival to ffmpeg.
+func startRemux(codec, format, name string, rtpTime bool, written *int64) (cmd *exec.Cmd, stdin io.WriteCloser, writer RTPWriter, err error) {
+	vc, err := lookupVideoCodec(codec)
+	if err != nil {
+		return
+	}
+	args := []string{"-hide_banner", "-loglevel", "error"}
+	if rtpTime {
+		args = append(args, "-f", "ivf")
+	} else {
+		args = append(args, "-use_wallclock_as_timestamps", "1", "-f", vc.format)
+	}
+	args = append(args, "-i", "pipe:0", "-c", "copy")
+	switch format {
+	case "mp4":
+		args = append(args, "-movflags", "frag_keyframe+empty_moov+default_base_moof", "-f", "mp4")
+	case "mkv":
+		args = append(args, "-f", "matroska")
+	}
+	args = append(args, "-y", name)
+
+	c := exec.Command("ffmpeg", args...)
+	in, err := c.StdinPipe()
+	if err != nil {
+		return
+	}
+	stderr, err := c.StderrPipe()
+	if err != nil {
+		return
+	}
+	err = c.Start()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	go func() {
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			log.Println("[rec]", scanner.Text())
+		}
+	}()
+
+	w := &countWriter{w: in, n: written}
+	switch {
+	case !rtpTime:
+		writer, err = newVideoWriter(codec, w, 0, 0)
+	case vc.fourcc == "":
+		writer, err = NewIVFWriter(w, ivfH264, 0, 0)
+	default:
+		writer, err = NewIVFWriter(w, vc.fourcc, 0, 0)
+	}
+	if err != nil {
+		in.Close()
+		c.Wait()
+		return
+	}
+	return c, in, writer, nil
+}
+
+//---------------------------------------------------------------------------------
+type countWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (c *countWriter) Write(p []byte) (n int, err error) {
+	n, err = c.w.Write(p)
+	*c.n += int64(n)
+	return
+}
+
+//=================================================================================
@@ -0,0 +1,68 @@
+//=================================================================================
+//	Filaname: record_test.go
+// 	Function: tests of the retention of record segments
+// 	Author: Stoney Kang, sikang@teamgrit.kr
+// 	Copyright: TeamGRIT, 2021
+//=================================================================================
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+//---------------------------------------------------------------------------------
+func TestRemoveOldSegments(t *testing.T) {
+	files := []string{
+		"cam_20240101-120000.000.mkv",
+		"cam_20240101-120001.000.mkv",
+		"cam_20240101-120002.000.mkv",
+		"cam_2_20240101-110000.000.mkv", // of channel cam_2
+		"cam_notes.mkv",
+	}
+	current := "cam_20240101-120003.000.mkv" // not yet made by ffmpeg
+
+	tests := []struct {
+		name string
+		keep int
+		left []string
+	}{
+		{"all", 0, files},
+		{"current only", 1, files[3:]},
+		{"current and one", 2, files[2:]},
+		{"current and all", 4, files},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, name := range files {
+				if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			r := &Recorder{Dir: dir, Channel: "cam", Format: "mkv", Keep: tt.keep, name: filepath.Join(dir, current)}
+			r.removeOldSegments()
+
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			left := []string{}
+			for _, e := range entries {
+				left = append(left, e.Name())
+			}
+			want := append([]string{}, tt.left...)
+			sort.Strings(want)
+			if !reflect.DeepEqual(left, want) {
+				t.Errorf("left %v, want %v", left, want)
+			}
+		})
+	}
+}
+
+//=================================================================================
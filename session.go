@@ -0,0 +1,368 @@
+//=================================================================================
+//	Filaname: session.go
+// 	Function: webrtc session with spider server and its supervisor
+// 	Author: Stoney Kang, sikang@teamgrit.kr
+// 	Copyright: TeamGRIT, 2021
+//=================================================================================
+package main
+
+import (
+	"errors"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v2"
+	"github.com/sikang99/spider-view/signaling"
+)
+
+//---------------------------------------------------------------------------------
+// superviseSession keeps a session with the spider server alive, reconnecting
+// with exponential backoff and jitter. ffmpeg and the window are not touched.
+func (d *Program) superviseSession() {
+	log.Println("i.superviseSession")
+
+	minBackoff := time.Duration(d.ReconnectMin) * time.Millisecond
+	maxBackoff := time.Duration(d.ReconnectMax) * time.Millisecond
+	if maxBackoff < minBackoff {
+		maxBackoff = minBackoff
+	}
+
+	backoff := minBackoff
+	for !d.quitting() {
+		started := time.Now()
+		d.setState(StateConnecting)
+		err := d.runSession()
+		log.Println("session closed:", err)
+		d.setState(StateDisconnected)
+		if d.quitting() {
+			break
+		}
+
+		// a rejected subscription fails again unless the token can be refreshed
+		var aerr *AuthError
+		if errors.As(err, &aerr) && d.AuthTokenFile == "" {
+			log.Println("stop reconnecting,", aerr)
+			d.setState(StateRejected)
+			break
+		}
+
+		// a session that lasted long enough resets the backoff
+		if time.Since(started) > maxBackoff {
+			backoff = minBackoff
+		}
+		delay := jitter(backoff)
+		log.Println("reconnect after", delay)
+		select {
+		case <-time.After(delay):
+		case <-d.ctx.Done():
+		}
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+//---------------------------------------------------------------------------------
+// States of the session shown to the operator
+const (
+	StateConnecting   = "connecting"
+	StateConnected    = "connected"
+	StateDisconnected = "disconnected"
+	StateRejected     = "rejected"
+)
+
+type sessionState struct {
+	sync.Mutex
+	state string
+	since time.Time
+}
+
+func (d *Program) setState(state string) {
+	d.state.Lock()
+	defer d.state.Unlock()
+	if d.state.state != state {
+		d.state.state = state
+		d.state.since = time.Now()
+	}
+}
+
+// State returns the state of the session and the time it changed
+func (d *Program) State() (state string, since time.Time) {
+	d.state.Lock()
+	defer d.state.Unlock()
+	return d.state.state, d.state.since
+}
+
+// jitter returns a random duration between d/2 and d
+func jitter(d time.Duration) time.Duration {
+	if d <= 1 {
+		return d
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)))
+}
+
+//---------------------------------------------------------------------------------
+// runSession connects to the remote peer by the signaler and negotiates a new
+// peer connection. It returns when the signaling or the ice connection is lost.
+func (d *Program) runSession() (err error) {
+	log.Println("i.runSession:", d.channel(), d.Signal)
+
+	sig, err := d.newSignaler()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	err = sig.Open()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	d.clock.reset()
+	done := make(chan struct{})
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			close(done)
+		})
+	}
+	d.mu.Lock()
+	d.stopSession = stop
+	d.mu.Unlock()
+
+	var wg sync.WaitGroup
+	var procErr error
+	defer func() {
+		stop()
+		sig.Close()
+		wg.Wait()
+		d.mu.Lock()
+		d.stopSession = nil
+		d.iceState = ""
+		d.videoSSRC = 0
+		d.mu.Unlock()
+		if err == nil {
+			err = procErr
+		}
+	}()
+
+	var fetched []ICEServerConfig
+	if f, ok := sig.(iceFetcher); ok && d.ICEFetch {
+		fetched, err = f.FetchICEServers(done)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+	}
+
+	gathered := make(chan struct{})
+	err = d.newPeerConnection(sig, fetched, gathered, done, stop)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer d.pc.Close()
+
+	err = d.addRecvMediaTranceivers(!d.AudioNouse, !d.VideoNouse)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		procErr = d.procSignaling(sig, done)
+		stop()
+	}()
+
+	err = d.sendOffer(sig, gathered, done)
+	if err != nil {
+		return
+	}
+	select {
+	case <-done:
+	case <-d.ctx.Done():
+	}
+	return
+}
+
+//---------------------------------------------------------------------------------
+func (d *Program) newPeerConnection(sig Signaler, fetched []ICEServerConfig, gathered, done chan struct{}, stop func()) (err error) {
+	log.Println("i.newPeerConnection")
+
+	rtcConfig, err := d.setRTCConfiguratrion(fetched)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	me := webrtc.MediaEngine{}
+	err = registerCodecs(&me, d.VideoCodec)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(me))
+	pc, err := api.NewPeerConnection(rtcConfig)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	d.mu.Lock()
+	d.pc = pc
+	d.mu.Unlock()
+
+	pc.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
+		log.Println("w.OnICEConnectionState:", connectionState)
+		d.mu.Lock()
+		d.iceState = connectionState.String()
+		d.mu.Unlock()
+		d.emit(EventICEState, map[string]interface{}{"state": connectionState.String()})
+		switch connectionState {
+		case webrtc.ICEConnectionStateConnected:
+			d.setState(StateConnected)
+		case webrtc.ICEConnectionStateDisconnected,
+			webrtc.ICEConnectionStateFailed,
+			webrtc.ICEConnectionStateClosed:
+			stop()
+		}
+	})
+
+	var gatherOnce sync.Once
+	pc.OnICECandidate(func(iceCandidate *webrtc.ICECandidate) {
+		log.Println("w.OnICECandidate:", iceCandidate)
+		if iceCandidate == nil {
+			// end of gathering
+			gatherOnce.Do(func() { close(gathered) })
+			return
+		}
+		if sig.Trickle() {
+			err := sig.Send(signaling.Candidate{ICECandidateInit: iceCandidate.ToJSON()})
+			if err != nil {
+				log.Println(err)
+			}
+		}
+	})
+
+	pc.OnTrack(func(track *webrtc.Track, receiver *webrtc.RTPReceiver) {
+		log.Println("w.OnTrack:", track.ID(), track.PayloadType(), track.Codec().RTPCodecCapability.MimeType)
+		d.emit(EventTrackAdded, map[string]interface{}{
+			"kind": track.Kind().String(), "codec": track.Codec().MimeType, "ssrc": track.SSRC()})
+		fb := d.newFeedback(pc, track.Kind() == webrtc.RTPCodecTypeVideo)
+		go d.readSenderReports(receiver, fb)
+
+		switch track.Kind() {
+		case webrtc.RTPCodecTypeVideo:
+			go fb.run(done)
+			d.receiveVideo(pc, track, fb, done)
+		case webrtc.RTPCodecTypeAudio:
+			go fb.run(done)
+			d.receiveAudio(track, fb, done)
+		default:
+			log.Println("ignore>", track.Kind(), "track:", track.ID())
+		}
+	})
+
+	pc.OnDataChannel(func(dc *webrtc.DataChannel) {
+		log.Println("w.OnDataChannel:", dc.ID(), dc.Label())
+	})
+	return
+}
+
+//---------------------------------------------------------------------------------
+// receiveVideo sends video packets to the decoder and the recorder in the container of the codec
+func (d *Program) receiveVideo(pc *webrtc.PeerConnection, track *webrtc.Track, fb *feedback, done chan struct{}) {
+	log.Println("i.receiveVideo:", track.ID(), track.Codec().MimeType)
+
+	d.mu.Lock()
+	d.videoSSRC = uint32(track.SSRC())
+	d.mu.Unlock()
+
+	// a new writer per track waits for the first key frame of the new stream
+	mime := track.Codec().MimeType
+	videoWriter, err := newVideoWriter(mime, d.decoder, d.VideoWidth, d.VideoHeight)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if recorder := d.getRecorder(); recorder != nil {
+		recorder.Rotate()
+	}
+	if d.clips != nil {
+		d.clips.Restart()
+	}
+	latency := time.Duration(d.JitterLatency) * time.Millisecond
+	if latency > 0 && latency < nackWindow {
+		log.Println("jitter latency", latency, "drops the retransmissions after it, nack waits", nackWindow)
+	}
+	jb := newJitterBuffer(latency,
+		func(payload []byte) bool { return isKeyFrame(mime, payload) }, &d.jstats, fb.needKeyFrame)
+
+	for !d.quitting() {
+		rtp, err := track.ReadRTP()
+		if err != nil {
+			log.Println(err)
+			return
+		}
+
+		if width, height, ok := probeVideoSize(mime, rtp.Payload); ok {
+			info := StreamInfo{Codec: d.VideoCodec, Width: width, Height: height}
+			if info != d.decoder.StreamInfo() {
+				log.Println("stream size:", width, "x", height)
+				err = d.decoder.SetStreamInfo(info)
+				if err != nil {
+					log.Println(err)
+				}
+			}
+		}
+
+		d.stats.add(rtp, videoClockRate)
+		fb.received(rtp, isKeyFrame(mime, rtp.Payload))
+
+		for _, pkt := range jb.push(rtp) {
+			if recorder := d.getRecorder(); recorder != nil {
+				err = recorder.WriteRTP(pkt)
+				if err != nil {
+					log.Println("recorder:", err)
+				}
+			}
+			if d.clips != nil {
+				err = d.clips.WriteRTP(pkt)
+				if err != nil {
+					log.Println("clip:", err)
+				}
+			}
+
+			err = videoWriter.WriteRTP(pkt)
+			if err == ErrDecoderRestarted {
+				// write the stream again from its header, starting with this packet if a key frame
+				d.pipeline.reset()
+				d.decoderRestarted()
+				videoWriter, err = newVideoWriter(mime, d.decoder, d.VideoWidth, d.VideoHeight)
+				if err == nil {
+					err = videoWriter.WriteRTP(pkt)
+				}
+				if err == nil && !isKeyFrame(mime, pkt.Payload) {
+					fb.requestKeyFrame()
+				}
+			}
+			if err == ErrDecoderClosed {
+				return
+			}
+			if err != nil {
+				log.Println(err)
+			} else if pkt.Marker {
+				d.pipeline.frameWritten()
+			}
+			d.clock.setVideo(d.clock.captureTime(pkt.SSRC, pkt.Timestamp, videoClockRate))
+		}
+	}
+}
+
+//=================================================================================
@@ -0,0 +1,315 @@
+//=================================================================================
+//	Filaname: signaler.go
+// 	Function: signaling transports to exchange offer, answer and candidates
+// 	Author: Stoney Kang, sikang@teamgrit.kr
+// 	Copyright: TeamGRIT, 2021
+//=================================================================================
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sikang99/spider-view/signaling"
+)
+
+//---------------------------------------------------------------------------------
+// Kinds of signaling
+const (
+	SignalSpider = "spider" // websocket of spider server
+	SignalWHEP   = "whep"   // webrtc-http egress protocol
+	SignalManual = "manual" // copy and paste of base64 sdp
+)
+
+// Signaler exchanges the offer, answer and candidates of a session
+type Signaler interface {
+	// Open connects to the remote peer
+	Open() error
+	// Send sends a message to the remote peer
+	Send(m signaling.Message) error
+	// Recv returns the messages from the remote peer, closed when lost
+	Recv() <-chan signaling.Message
+	// Trickle tells whether candidates are sent one by one,
+	// or in the sdp of the offer after gathering
+	Trickle() bool
+	Close() error
+}
+
+// iceFetcher is a signaler able to give the ice servers of the session
+type iceFetcher interface {
+	FetchICEServers(done chan struct{}) ([]ICEServerConfig, error)
+}
+
+// newSignaler returns the signaler by the flag or the scheme of url
+func (d *Program) newSignaler() (sig Signaler, err error) {
+	d.mu.Lock()
+	rawurl := d.URL
+	d.mu.Unlock()
+
+	kind := strings.ToLower(d.Signal)
+	if kind == "" {
+		u, err := url.Parse(rawurl)
+		if err != nil {
+			return nil, err
+		}
+		switch u.Scheme {
+		case "ws", "wss":
+			kind = SignalSpider
+		case "http", "https":
+			kind = SignalWHEP
+		default:
+			return nil, fmt.Errorf("no signaling for url: %s", rawurl)
+		}
+	}
+
+	switch kind {
+	case SignalSpider:
+		sig = &spiderSignaler{d: d, url: rawurl}
+	case SignalWHEP:
+		sig = &whepSignaler{d: d, url: rawurl}
+	case SignalManual:
+		sig = &manualSignaler{}
+	default:
+		err = fmt.Errorf("unknown signaling: %s", d.Signal)
+	}
+	return
+}
+
+//---------------------------------------------------------------------------------
+// spiderSignaler is the signaling by the websocket of spider server
+type spiderSignaler struct {
+	d       *Program
+	url     string
+	ws      *websocket.Conn
+	mu      sync.Mutex // only one writer at a time
+	recv    chan signaling.Message
+	ice     chan []ICEServerConfig
+	vmu     sync.Mutex
+	version int           // signaling protocol version negotiated, guarded by vmu
+	hello   chan struct{} // closed at hello from the server
+	helloBy time.Time     // time to give up the hello, for an old server
+	done    chan struct{}
+	read    chan struct{} // closed when reading ends
+	once    sync.Once
+	wg      sync.WaitGroup
+}
+
+const (
+	closeTimeout = time.Second // max wait for the close reply of the server
+	helloTimeout = time.Second // max wait for the hello of the server
+)
+
+func (s *spiderSignaler) Open() (err error) {
+	s.ws, err = s.d.connectWebsocketByUrl(s.url, 1024)
+	if err != nil {
+		return
+	}
+	s.recv = make(chan signaling.Message, 2)
+	s.ice = make(chan []ICEServerConfig, 1)
+	s.version = signaling.Version1 // until hello from the server
+	s.hello = make(chan struct{})
+	s.helloBy = time.Now().Add(helloTimeout)
+	s.done = make(chan struct{})
+	s.read = make(chan struct{})
+
+	s.wg.Add(2)
+	go s.readMessages()
+	go s.keepAlive(30 * time.Second)
+
+	// an old server ignores hello and stays at version 1
+	err = s.Send(signaling.NewHello("spider-view/" + Version))
+	if err != nil {
+		s.Close()
+	}
+	return
+}
+
+// Send writes a message, but not the one of a version newer than the server's
+func (s *spiderSignaler) Send(m signaling.Message) (err error) {
+	if m.Type() != signaling.TypeHello {
+		if version := s.protocol(); signaling.VersionOf(m.Type()) > version {
+			return &signaling.Error{Kind: signaling.ErrVersion, Type: m.Type(),
+				Err: fmt.Errorf("server at version %d", version)}
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return writeMessage(s.ws, m)
+}
+
+// protocol returns the version negotiated, waiting for the hello of the server
+// until helloBy, and version 1 without it
+func (s *spiderSignaler) protocol() int {
+	if wait := time.Until(s.helloBy); wait > 0 {
+		timer := time.NewTimer(wait)
+		select {
+		case <-s.hello:
+		case <-s.read:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+	s.vmu.Lock()
+	defer s.vmu.Unlock()
+	return s.version
+}
+
+func (s *spiderSignaler) Recv() <-chan signaling.Message {
+	return s.recv
+}
+
+func (s *spiderSignaler) Trickle() bool {
+	return true
+}
+
+func (s *spiderSignaler) Close() error {
+	s.once.Do(func() {
+		close(s.done)
+
+		// close handshake, the server replies and then reading ends
+		err := s.ws.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, "bye"),
+			time.Now().Add(closeTimeout))
+		if err == nil {
+			select {
+			case <-s.read:
+			case <-time.After(closeTimeout):
+				log.Println("no close reply from the server")
+			}
+		}
+		s.ws.Close()
+	})
+	s.wg.Wait()
+	return nil
+}
+
+// FetchICEServers asks the spider server for the ice servers of the session
+func (s *spiderSignaler) FetchICEServers(done chan struct{}) (servers []ICEServerConfig, err error) {
+	log.Println("i.FetchICEServers")
+
+	// an old server has no ice servers to give, the configured ones are used
+	if version := s.protocol(); version < signaling.VersionOf(signaling.TypeGetICE) {
+		log.Println("no ice servers of the server at version", version)
+		return
+	}
+
+	err = s.Send(signaling.GetICEServers{})
+	if err != nil {
+		return
+	}
+
+	timeout := time.NewTimer(iceFetchTimeout)
+	defer timeout.Stop()
+	select {
+	case <-done:
+		err = fmt.Errorf("session closed")
+	case <-s.done:
+		err = fmt.Errorf("signaling closed")
+	case <-timeout.C:
+		// an old server does not know it, continue with the configured servers
+		log.Println("no ice servers from spider server")
+	case servers = <-s.ice:
+		log.Println("ice servers from spider server:", len(servers))
+	}
+	return
+}
+
+// readMessages passes messages of the session to Recv, and handles the others
+func (s *spiderSignaler) readMessages() {
+	defer s.wg.Done()
+	defer close(s.read)
+	defer close(s.recv)
+
+	for {
+		env := signaling.Envelope{}
+		err := s.ws.ReadJSON(&env)
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				log.Println(err)
+			}
+			return
+		}
+		m, err := signaling.Decode(env)
+		if err != nil {
+			// skip the message, the session goes on
+			log.Println("[msg]", err)
+			continue
+		}
+
+		switch m := m.(type) {
+		case signaling.Ping, signaling.Pong, signaling.Joins:
+			log.Println("[msg]", signaling.String(m))
+		case signaling.Hello:
+			select {
+			case <-s.hello:
+				log.Println("[msg] hello again, ignored")
+				continue
+			default:
+			}
+			version, err := signaling.Negotiate(signaling.NewHello(""), m)
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			s.vmu.Lock()
+			s.version = version
+			s.vmu.Unlock()
+			close(s.hello)
+			log.Println("[msg] hello, version", version, m.Agent)
+		case signaling.ServerError:
+			log.Println("[msg] error:", m.Code, m.Message)
+		case signaling.ICEServers:
+			servers := []ICEServerConfig{}
+			for _, v := range m.Servers {
+				servers = append(servers, ICEServerConfig{
+					URLs:       v.URLs,
+					Username:   v.Username,
+					Credential: v.Credential,
+				})
+			}
+			select {
+			case s.ice <- servers:
+			default:
+			}
+		default:
+			select {
+			case s.recv <- m:
+			case <-s.done:
+				return
+			}
+		}
+	}
+}
+
+// keepAlive sends ping to the server periodically
+func (s *spiderSignaler) keepAlive(interval time.Duration) {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.Send(signaling.Ping{})
+		}
+	}
+}
+
+// writeMessage writes a message to the websocket
+func writeMessage(ws *websocket.Conn, m signaling.Message) (err error) {
+	env, err := signaling.Encode(m)
+	if err != nil {
+		return
+	}
+	return ws.WriteJSON(&env)
+}
+
+//=================================================================================
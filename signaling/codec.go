@@ -0,0 +1,130 @@
+//=================================================================================
+//	Filaname: codec.go
+// 	Function: encoding and decoding of signaling messages
+// 	Author: Stoney Kang, sikang@teamgrit.kr
+// 	Copyright: TeamGRIT, 2021
+//=================================================================================
+package signaling
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/pion/webrtc/v2"
+)
+
+//---------------------------------------------------------------------------------
+// Encode puts a message into an envelope
+func Encode(m Message) (env Envelope, err error) {
+	env.Type = m.Type()
+
+	switch m := m.(type) {
+	case Offer:
+		env.Data = m.SDP
+	case Answer:
+		env.Data = m.SDP
+	case Candidate:
+		if m.Legacy {
+			env.Data = m.Candidate
+			break
+		}
+		env.Data, err = marshal(m.ICECandidateInit)
+	case Joins:
+		env.Data = m.Data
+	case Ping, Pong, GetICEServers:
+	case ICEServers:
+		env.Data, err = marshal(m.Servers)
+	case Hello, ServerError:
+		env.Data, err = marshal(m)
+	default:
+		err = &Error{Kind: ErrUnknownType, Type: env.Type}
+	}
+	if err != nil {
+		if _, ok := err.(*Error); !ok {
+			err = &Error{Kind: ErrMalformed, Type: env.Type, Err: err}
+		}
+	}
+	return
+}
+
+// Decode takes a typed message out of an envelope
+func Decode(env Envelope) (m Message, err error) {
+	switch env.Type {
+	case TypeOffer:
+		m = Offer{SDP: env.Data}
+	case TypeAnswer:
+		m = Answer{SDP: env.Data}
+	case TypeCandidate:
+		m = Candidate{ICECandidateInit: webrtc.ICECandidateInit{Candidate: env.Data}, Legacy: true}
+	case TypeCandidate2:
+		c := Candidate{}
+		err = unmarshal(env, &c.ICECandidateInit)
+		m = c
+	case TypePing:
+		m = Ping{}
+	case TypePong:
+		m = Pong{}
+	case TypeJoins:
+		m = Joins{Data: env.Data}
+	case TypeGetICE:
+		m = GetICEServers{}
+	case TypeICEServers:
+		s := ICEServers{}
+		err = unmarshal(env, &s.Servers)
+		m = s
+	case TypeHello:
+		h := Hello{}
+		err = unmarshal(env, &h)
+		m = h
+	case TypeError:
+		e := ServerError{}
+		err = unmarshal(env, &e)
+		m = e
+	default:
+		err = &Error{Kind: ErrUnknownType, Type: env.Type}
+	}
+	if err != nil {
+		m = nil
+	}
+	return
+}
+
+// Marshal encodes a message into json of the wire
+func Marshal(m Message) ([]byte, error) {
+	env, err := Encode(m)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(env)
+}
+
+// Unmarshal decodes json of the wire into a message
+func Unmarshal(data []byte) (Message, error) {
+	env := Envelope{}
+	err := json.Unmarshal(data, &env)
+	if err != nil {
+		return nil, &Error{Kind: ErrMalformed, Err: err}
+	}
+	return Decode(env)
+}
+
+//---------------------------------------------------------------------------------
+func marshal(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	return string(data), err
+}
+
+func unmarshal(env Envelope, v interface{}) error {
+	err := json.Unmarshal([]byte(env.Data), v)
+	if err != nil {
+		return &Error{Kind: ErrMalformed, Type: env.Type, Err: err}
+	}
+	return nil
+}
+
+// String shows a message for logging
+func String(m Message) string {
+	return fmt.Sprintf("%s %+v", m.Type(), m)
+}
+
+//=================================================================================
@@ -0,0 +1,115 @@
+//=================================================================================
+//	Filaname: codec_test.go
+// 	Function: tests of encoding and decoding of signaling messages
+// 	Author: Stoney Kang, sikang@teamgrit.kr
+// 	Copyright: TeamGRIT, 2021
+//=================================================================================
+package signaling
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/pion/webrtc/v2"
+)
+
+//---------------------------------------------------------------------------------
+func TestEncodeDecode(t *testing.T) {
+	mid, index := "0", uint16(0)
+
+	tests := []struct {
+		name string
+		m    Message
+		env  Envelope
+	}{
+		{"offer", Offer{SDP: "v=0"}, Envelope{TypeOffer, "v=0"}},
+		{"answer", Answer{SDP: "v=0"}, Envelope{TypeAnswer, "v=0"}},
+		{"legacy candidate", Candidate{ICECandidateInit: webrtc.ICECandidateInit{Candidate: "candidate:1"}, Legacy: true},
+			Envelope{TypeCandidate, "candidate:1"}},
+		{"candidate", Candidate{ICECandidateInit: webrtc.ICECandidateInit{Candidate: "candidate:1", SDPMid: &mid, SDPMLineIndex: &index}},
+			Envelope{TypeCandidate2, `{"candidate":"candidate:1","sdpMid":"0","sdpMLineIndex":0,"usernameFragment":""}`}},
+		{"ping", Ping{}, Envelope{TypePing, ""}},
+		{"pong", Pong{}, Envelope{TypePong, ""}},
+		{"joins", Joins{Data: "2 peers"}, Envelope{TypeJoins, "2 peers"}},
+		{"get ice servers", GetICEServers{}, Envelope{TypeGetICE, ""}},
+		{"ice servers", ICEServers{Servers: []ICEServer{{URLs: []string{"turn:a"}, Username: "u", Credential: "c"}}},
+			Envelope{TypeICEServers, `[{"urls":["turn:a"],"username":"u","credential":"c"}]`}},
+		{"hello", Hello{Version: 2, MinVersion: 1, Agent: "spider-view"},
+			Envelope{TypeHello, `{"version":2,"min_version":1,"agent":"spider-view"}`}},
+		{"error", ServerError{Code: 404, Message: "no channel"},
+			Envelope{TypeError, `{"code":404,"message":"no channel"}`}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env, err := Encode(tt.m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if env != tt.env {
+				t.Errorf("Encode = %+v, want %+v", env, tt.env)
+			}
+
+			m, err := Decode(env)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(m, tt.m) {
+				t.Errorf("Decode = %#v, want %#v", m, tt.m)
+			}
+		})
+	}
+}
+
+// unknown is a message not of the protocol
+type unknown struct{}
+
+func (unknown) Type() string { return "unknown" }
+
+func TestEncodeDecodeErrors(t *testing.T) {
+	_, err := Encode(unknown{})
+	if !errors.Is(err, ErrUnknownType) {
+		t.Errorf("Encode unknown = %v, want %v", err, ErrUnknownType)
+	}
+
+	tests := []struct {
+		name string
+		data string
+		kind error
+	}{
+		{"not json", `{"type":`, ErrMalformed},
+		{"unknown type", `{"type":"bye","data":""}`, ErrUnknownType},
+		{"malformed hello", `{"type":"hello","data":"v2"}`, ErrMalformed},
+		{"malformed ice servers", `{"type":"ice-servers","data":"{}"}`, ErrMalformed},
+		{"malformed candidate", `{"type":"candidate2","data":"candidate:1"}`, ErrMalformed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := Unmarshal([]byte(tt.data))
+			if !errors.Is(err, tt.kind) {
+				t.Errorf("Unmarshal = %v, want %v", err, tt.kind)
+			}
+			if m != nil {
+				t.Errorf("Unmarshal message = %#v, want nil", m)
+			}
+		})
+	}
+}
+
+func TestMarshalUnmarshal(t *testing.T) {
+	data, err := Marshal(Offer{SDP: "v=0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"type":"offer","data":"v=0"}`; string(data) != want {
+		t.Errorf("Marshal = %s, want %s", data, want)
+	}
+	m, err := Unmarshal(data)
+	if err != nil || m != (Offer{SDP: "v=0"}) {
+		t.Errorf("Unmarshal = %#v, %v", m, err)
+	}
+}
+
+//=================================================================================
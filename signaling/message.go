@@ -0,0 +1,110 @@
+//=================================================================================
+//	Filaname: message.go
+// 	Function: typed messages of the spider signaling protocol
+// 	Author: Stoney Kang, sikang@teamgrit.kr
+// 	Copyright: TeamGRIT, 2021
+//=================================================================================
+
+// Package signaling implements the signaling protocol of the spider server,
+// typed messages over the {type, data} envelope and the version negotiation.
+package signaling
+
+import (
+	"github.com/pion/webrtc/v2"
+)
+
+//---------------------------------------------------------------------------------
+// Types of messages on the wire
+const (
+	TypeHello      = "hello"       // v2, protocol version
+	TypeOffer      = "offer"       // sdp of offer
+	TypeAnswer     = "answer"      // sdp of answer
+	TypeCandidate  = "candidate"   // v1, candidate line, old style of pion/mediadevices
+	TypeCandidate2 = "candidate2"  // candidate init in json, standard type
+	TypePing       = "ping"        // keepalive
+	TypePong       = "pong"        // reply of ping
+	TypeJoins      = "joins"       // notice of peers joined to the channel
+	TypeGetICE     = "get-ice"     // v2, request of ice servers
+	TypeICEServers = "ice-servers" // v2, ice servers in json
+	TypeError      = "error"       // v2, error of the server
+)
+
+// Envelope is a message on the wire, data is sdp, text or json by its type
+type Envelope struct {
+	Type string `json:"type"`
+	Data string `json:"data"`
+}
+
+// Message is a typed message of the protocol
+type Message interface {
+	Type() string
+}
+
+//---------------------------------------------------------------------------------
+// Hello tells the versions of protocol supported by a peer
+type Hello struct {
+	Version    int    `json:"version"`
+	MinVersion int    `json:"min_version,omitempty"`
+	Agent      string `json:"agent,omitempty"`
+}
+
+type Offer struct {
+	SDP string
+}
+
+type Answer struct {
+	SDP string
+}
+
+// Candidate is an ice candidate, Legacy for the old style of candidate line only
+type Candidate struct {
+	webrtc.ICECandidateInit
+	Legacy bool
+}
+
+type Ping struct{}
+
+type Pong struct{}
+
+// Joins is a notice of the server, kept as it is
+type Joins struct {
+	Data string
+}
+
+type GetICEServers struct{}
+
+// ICEServer is an ice server given by the spider server
+type ICEServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+type ICEServers struct {
+	Servers []ICEServer
+}
+
+// ServerError is an error reported by the spider server
+type ServerError struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message"`
+}
+
+func (Hello) Type() string         { return TypeHello }
+func (Offer) Type() string         { return TypeOffer }
+func (Answer) Type() string        { return TypeAnswer }
+func (Ping) Type() string          { return TypePing }
+func (Pong) Type() string          { return TypePong }
+func (Joins) Type() string         { return TypeJoins }
+func (GetICEServers) Type() string { return TypeGetICE }
+func (ICEServers) Type() string    { return TypeICEServers }
+func (ServerError) Type() string   { return TypeError }
+
+func (c Candidate) Type() string {
+	if c.Legacy {
+		return TypeCandidate
+	}
+	return TypeCandidate2
+}
+
+//=================================================================================
@@ -0,0 +1,90 @@
+//=================================================================================
+//	Filaname: version.go
+// 	Function: errors and version negotiation of the signaling protocol
+// 	Author: Stoney Kang, sikang@teamgrit.kr
+// 	Copyright: TeamGRIT, 2021
+//=================================================================================
+package signaling
+
+import (
+	"errors"
+	"fmt"
+)
+
+//---------------------------------------------------------------------------------
+// Versions of the protocol. Version 1 is the protocol before hello, assumed
+// until a hello is received from the server.
+const (
+	Version1 = 1
+	Version2 = 2 // hello, get-ice, ice-servers, error
+
+	Version    = Version2
+	MinVersion = Version1
+)
+
+var (
+	ErrUnknownType = errors.New("signaling: unknown message type")
+	ErrMalformed   = errors.New("signaling: malformed message")
+	ErrVersion     = errors.New("signaling: no common protocol version")
+)
+
+// Error is a structured error of a message, matched by errors.Is with its Kind
+type Error struct {
+	Kind error  // ErrUnknownType, ErrMalformed or ErrVersion
+	Type string // type of the message
+	Err  error  // cause of the error if any
+}
+
+func (e *Error) Error() string {
+	s := e.Kind.Error()
+	if e.Type != "" {
+		s += fmt.Sprintf(" %q", e.Type)
+	}
+	if e.Err != nil {
+		s += ": " + e.Err.Error()
+	}
+	return s
+}
+
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+//---------------------------------------------------------------------------------
+// VersionOf returns the protocol version required by the type of message
+func VersionOf(typ string) int {
+	switch typ {
+	case TypeHello, TypeGetICE, TypeICEServers, TypeError:
+		return Version2
+	}
+	return Version1
+}
+
+// NewHello returns the hello of this package to send on connect
+func NewHello(agent string) Hello {
+	return Hello{
+		Version:    Version,
+		MinVersion: MinVersion,
+		Agent:      agent,
+	}
+}
+
+// Negotiate returns the highest version supported by both of local and remote
+func Negotiate(local, remote Hello) (version int, err error) {
+	version = local.Version
+	if remote.Version < version {
+		version = remote.Version
+	}
+	if version < local.MinVersion || version < remote.MinVersion {
+		return 0, &Error{Kind: ErrVersion, Type: TypeHello,
+			Err: fmt.Errorf("local %d-%d, remote %d-%d",
+				local.MinVersion, local.Version, remote.MinVersion, remote.Version)}
+	}
+	return
+}
+
+//=================================================================================
@@ -0,0 +1,67 @@
+//=================================================================================
+//	Filaname: version_test.go
+// 	Function: tests of version negotiation of the signaling protocol
+// 	Author: Stoney Kang, sikang@teamgrit.kr
+// 	Copyright: TeamGRIT, 2021
+//=================================================================================
+package signaling
+
+import (
+	"errors"
+	"testing"
+)
+
+//---------------------------------------------------------------------------------
+func TestNegotiate(t *testing.T) {
+	local := NewHello("")
+
+	tests := []struct {
+		name    string
+		remote  Hello
+		version int
+		err     error
+	}{
+		{"same", Hello{Version: 2, MinVersion: 1}, 2, nil},
+		{"older", Hello{Version: 1, MinVersion: 1}, 1, nil},
+		{"newer", Hello{Version: 3, MinVersion: 2}, 2, nil},
+		{"no min version", Hello{Version: 1}, 1, nil},
+		{"too new", Hello{Version: 4, MinVersion: 3}, 0, ErrVersion},
+		{"too old", Hello{Version: 0}, 0, ErrVersion},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			version, err := Negotiate(local, tt.remote)
+			if version != tt.version || !errors.Is(err, tt.err) {
+				t.Errorf("Negotiate = %d, %v, want %d, %v", version, err, tt.version, tt.err)
+			}
+		})
+	}
+}
+
+func TestVersionOf(t *testing.T) {
+	tests := []struct {
+		typ     string
+		version int
+	}{
+		{TypeHello, Version2},
+		{TypeOffer, Version1},
+		{TypeAnswer, Version1},
+		{TypeCandidate, Version1},
+		{TypeCandidate2, Version1},
+		{TypePing, Version1},
+		{TypePong, Version1},
+		{TypeJoins, Version1},
+		{TypeGetICE, Version2},
+		{TypeICEServers, Version2},
+		{TypeError, Version2},
+	}
+
+	for _, tt := range tests {
+		if version := VersionOf(tt.typ); version != tt.version {
+			t.Errorf("VersionOf(%q) = %d, want %d", tt.typ, version, tt.version)
+		}
+	}
+}
+
+//=================================================================================
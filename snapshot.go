@@ -0,0 +1,230 @@
+//=================================================================================
+//	Filaname: snapshot.go
+// 	Function: snapshot of the last frame displayed, on demand and periodically
+// 	Author: Stoney Kang, sikang@teamgrit.kr
+// 	Copyright: TeamGRIT, 2021
+//=================================================================================
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+//---------------------------------------------------------------------------------
+var errNoFrame = errors.New("no frame yet")
+
+// snapshotWait is the max time a snapshot waits for the next frame,
+// then it takes the last one copied if the stream is paused
+const snapshotWait = 2 * time.Second
+
+// snapshotFormat returns the image type and content type of the format
+func snapshotFormat(format string) (ext gocv.FileExt, ctype string, err error) {
+	switch strings.ToLower(format) {
+	case "jpg", "jpeg":
+		return gocv.JPEGFileExt, "image/jpeg", nil
+	case "png":
+		return gocv.PNGFileExt, "image/png", nil
+	}
+	return "", "", fmt.Errorf("unknown snapshot format: %s", format)
+}
+
+// setFrame gives a copy of the frame to the snapshots waiting for it, clean of
+// the overlays drawn later into the data of the frame by motion detection.
+// The frame is not copied if no snapshot is waiting.
+func (d *Program) setFrame(frame *Frame) {
+	d.mu.Lock()
+	waits := d.frameWaits
+	d.frameWaits = nil
+	d.mu.Unlock()
+	if len(waits) == 0 {
+		return
+	}
+
+	clean := *frame
+	clean.Data = append([]byte(nil), frame.Data...)
+
+	d.mu.Lock()
+	d.lastFrame = &clean
+	d.mu.Unlock()
+	for _, ch := range waits {
+		ch <- &clean
+	}
+}
+
+// nextFrame waits for the next frame, or returns the last one copied
+// if none in snapshotWait
+func (d *Program) nextFrame() (frame *Frame, err error) {
+	ch := make(chan *Frame, 1)
+	d.mu.Lock()
+	d.frameWaits = append(d.frameWaits, ch)
+	d.mu.Unlock()
+
+	select {
+	case frame = <-ch:
+		return
+	case <-time.After(snapshotWait):
+	case <-d.ctx.Done():
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i, c := range d.frameWaits {
+		if c == ch {
+			d.frameWaits = append(d.frameWaits[:i], d.frameWaits[i+1:]...)
+			break
+		}
+	}
+	select {
+	case frame = <-ch: // given while waiting for mu
+		return
+	default:
+	}
+	if d.lastFrame == nil {
+		return nil, errNoFrame
+	}
+	return d.lastFrame, nil
+}
+
+// snapshot encodes the last frame in jpg or png
+func (d *Program) snapshot(format string) (data []byte, err error) {
+	ext, _, err := snapshotFormat(format)
+	if err != nil {
+		return
+	}
+
+	frame, err := d.nextFrame()
+	if err != nil {
+		return
+	}
+
+	img, err := gocv.NewMatFromBytes(frame.Height, frame.Width, gocv.MatTypeCV8UC3, frame.Data)
+	if err != nil {
+		return
+	}
+	defer img.Close()
+
+	buf, err := gocv.IMEncode(ext, img)
+	if err != nil {
+		return
+	}
+	defer buf.Close()
+	data = append([]byte(nil), buf.GetBytes()...)
+	return
+}
+
+// saveSnapshot writes the last frame to a new file in the snapshot dir
+func (d *Program) saveSnapshot(format string) (name string, err error) {
+	ext, _, err := snapshotFormat(format)
+	if err != nil {
+		return
+	}
+	data, err := d.snapshot(format)
+	if err != nil {
+		return
+	}
+
+	name = filepath.Join(d.SnapshotDir,
+		fmt.Sprintf("%s_%s%s", d.channel(), time.Now().Format("20060102-150405.000"), ext))
+	err = writeFileAtomic(name, data)
+	if err != nil {
+		return
+	}
+	log.Println("snapshot saved:", name)
+	return
+}
+
+// saveSnapshots saves the snapshots of all channels, by key or signal
+func (d *Program) saveSnapshots() {
+	for _, p := range d.programs() {
+		_, err := p.saveSnapshot(d.SnapshotFormat)
+		if err != nil {
+			log.Println(p.channel(), err)
+		}
+	}
+}
+
+// snapshotBySignal saves the snapshots of all channels at SIGUSR1
+func (d *Program) snapshotBySignal() {
+	sigch := make(chan os.Signal, 1)
+	signal.Notify(sigch, syscall.SIGUSR1)
+	defer signal.Stop(sigch)
+
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case sig := <-sigch:
+			log.Println("signal:", sig)
+			d.saveSnapshots()
+		}
+	}
+}
+
+//---------------------------------------------------------------------------------
+// runThumbnails overwrites the thumbnail of the channel, named by the channel id,
+// every SnapshotInterval until shutdown. The dashboard shows them as previews.
+func (d *Program) runThumbnails() {
+	if d.SnapshotInterval <= 0 {
+		return
+	}
+	log.Println("i.runThumbnails:", d.channel(), d.SnapshotInterval, "sec")
+
+	ticker := time.NewTicker(time.Duration(d.SnapshotInterval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		err := d.saveThumbnail()
+		if err != nil && err != errNoFrame {
+			log.Println(err)
+		}
+	}
+}
+
+// saveThumbnail overwrites the thumbnail of the channel with the last frame
+func (d *Program) saveThumbnail() (err error) {
+	ext, _, err := snapshotFormat(d.SnapshotFormat)
+	if err != nil {
+		return
+	}
+	data, err := d.snapshot(d.SnapshotFormat)
+	if err != nil {
+		return
+	}
+	return writeFileAtomic(filepath.Join(d.SnapshotDir, d.channel()+string(ext)), data)
+}
+
+// writeFileAtomic writes the file by renaming a temporary one,
+// not to show a partial image to the readers
+func writeFileAtomic(name string, data []byte) (err error) {
+	err = os.MkdirAll(filepath.Dir(name), 0755)
+	if err != nil {
+		return
+	}
+	tmp := name + ".tmp"
+	err = os.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return
+	}
+	err = os.Rename(tmp, name)
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return
+}
+
+//=================================================================================
@@ -0,0 +1,244 @@
+//=================================================================================
+//	Filaname: stats.go
+// 	Function: statistics of the stream received and the pipeline
+// 	Author: Stoney Kang, sikang@teamgrit.kr
+// 	Copyright: TeamGRIT, 2021
+//=================================================================================
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+)
+
+//---------------------------------------------------------------------------------
+const rateWindow = time.Second
+
+// receiveStats counts the packets of a track with the bit rate of the last window,
+// and the loss and jitter of the current ssrc by RFC 3550
+type receiveStats struct {
+	sync.Mutex
+	packets  uint64
+	bytes    uint64
+	winStart time.Time
+	winBytes uint64
+	bitrate  int
+
+	ssrc        uint32
+	clockRate   uint32
+	baseSeq     uint32
+	maxSeq      uint16
+	cycles      uint32
+	received    uint32
+	jitter      float64 // in units of clock rate
+	lastTransit int64
+	started     time.Time
+	// of the last receiver report
+	expectedPrior int64
+	receivedPrior int64
+}
+
+func (s *receiveStats) add(pkt *rtp.Packet, clockRate uint32) {
+	s.Lock()
+	defer s.Unlock()
+	s.packets++
+	s.bytes += uint64(len(pkt.Raw))
+
+	now := time.Now()
+	if s.winStart.IsZero() {
+		s.winStart = now
+	}
+	s.winBytes += uint64(len(pkt.Raw))
+	if elapsed := now.Sub(s.winStart); elapsed >= rateWindow {
+		s.bitrate = int(float64(s.winBytes*8) / elapsed.Seconds())
+		s.winStart = now
+		s.winBytes = 0
+	}
+
+	if s.received == 0 || pkt.SSRC != s.ssrc {
+		s.ssrc, s.clockRate = pkt.SSRC, clockRate
+		s.baseSeq, s.maxSeq, s.cycles = uint32(pkt.SequenceNumber), pkt.SequenceNumber, 0
+		s.received, s.jitter, s.lastTransit = 0, 0, 0
+		s.expectedPrior, s.receivedPrior = 0, 0
+		s.started = now
+	}
+	s.received++
+
+	// sequence number wrapped forward
+	if delta := pkt.SequenceNumber - s.maxSeq; delta < 0x8000 && delta != 0 {
+		if pkt.SequenceNumber < s.maxSeq {
+			s.cycles += 1 << 16
+		}
+		s.maxSeq = pkt.SequenceNumber
+	}
+
+	arrival := int64(now.Sub(s.started).Seconds() * float64(clockRate))
+	transit := arrival - int64(pkt.Timestamp)
+	if s.received > 1 {
+		d := transit - s.lastTransit
+		if d < 0 {
+			d = -d
+		}
+		s.jitter += (float64(d) - s.jitter) / 16
+	}
+	s.lastTransit = transit
+}
+
+// Bitrate returns bps of the last window, 0 if nothing received recently
+func (s *receiveStats) Bitrate() int {
+	s.Lock()
+	defer s.Unlock()
+	if time.Since(s.winStart) > 2*rateWindow {
+		return 0
+	}
+	return s.bitrate
+}
+
+// Counts returns the packets and bytes received in total
+func (s *receiveStats) Counts() (packets, bytes uint64) {
+	s.Lock()
+	defer s.Unlock()
+	return s.packets, s.bytes
+}
+
+// Loss returns the packets lost of the current ssrc, negative for duplicates
+func (s *receiveStats) Loss() int64 {
+	s.Lock()
+	defer s.Unlock()
+	if s.received == 0 {
+		return 0
+	}
+	expected := int64(s.cycles+uint32(s.maxSeq)) - int64(s.baseSeq) + 1
+	return expected - int64(s.received)
+}
+
+// Jitter returns the interarrival jitter of the current ssrc
+func (s *receiveStats) Jitter() time.Duration {
+	s.Lock()
+	defer s.Unlock()
+	if s.clockRate == 0 {
+		return 0
+	}
+	return time.Duration(s.jitter / float64(s.clockRate) * float64(time.Second))
+}
+
+// receptionReport returns the report block of the current ssrc by RFC 3550 A.3,
+// with the fraction lost since the last report
+func (s *receiveStats) receptionReport() (r rtcp.ReceptionReport, ok bool) {
+	s.Lock()
+	defer s.Unlock()
+	if s.received == 0 {
+		return
+	}
+
+	extMax := s.cycles + uint32(s.maxSeq)
+	expected := int64(extMax) - int64(s.baseSeq) + 1
+	lost := expected - int64(s.received)
+	if lost < 0 {
+		lost = 0
+	} else if lost > 0x7fffff {
+		lost = 0x7fffff
+	}
+
+	expectedInterval := expected - s.expectedPrior
+	lostInterval := expectedInterval - (int64(s.received) - s.receivedPrior)
+	s.expectedPrior, s.receivedPrior = expected, int64(s.received)
+	var fraction uint8
+	if expectedInterval > 0 && lostInterval > 0 {
+		fraction = uint8((lostInterval << 8) / expectedInterval)
+	}
+
+	r = rtcp.ReceptionReport{
+		SSRC:               s.ssrc,
+		FractionLost:       fraction,
+		TotalLost:          uint32(lost),
+		LastSequenceNumber: extMax,
+		Jitter:             uint32(s.jitter),
+	}
+	return r, true
+}
+
+//---------------------------------------------------------------------------------
+// Buckets of decode latency in sec
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5}
+
+const maxFramesInDecoder = 60
+
+// pipelineStats counts the frames through the decoder and the display.
+// Decode latency is from the last packet of a frame written to the decoder
+// until a frame is read, matched in order as the decoder keeps it.
+type pipelineStats struct {
+	sync.Mutex
+	written   []time.Time // frames in the decoder
+	decoded   uint64
+	displayed uint64
+	plis      uint64
+	nacks     uint64
+	buckets   []uint64 // counts of latency by latencyBuckets
+	count     uint64
+	sum       float64
+}
+
+// frameWritten is called when the last packet of a frame is written to the decoder
+func (p *pipelineStats) frameWritten() {
+	p.Lock()
+	defer p.Unlock()
+	if len(p.written) >= maxFramesInDecoder {
+		// frames dropped by the decoder, not to drift
+		p.written = p.written[1:]
+	}
+	p.written = append(p.written, time.Now())
+}
+
+// frameDecoded is called when a frame is read from the decoder
+func (p *pipelineStats) frameDecoded() {
+	p.Lock()
+	defer p.Unlock()
+	p.decoded++
+	if len(p.written) == 0 {
+		return
+	}
+	latency := time.Since(p.written[0]).Seconds()
+	p.written = p.written[1:]
+
+	if p.buckets == nil {
+		p.buckets = make([]uint64, len(latencyBuckets))
+	}
+	for i, le := range latencyBuckets {
+		if latency <= le {
+			p.buckets[i]++
+		}
+	}
+	p.count++
+	p.sum += latency
+}
+
+// reset forgets the frames in the decoder when it is restarted
+func (p *pipelineStats) reset() {
+	p.Lock()
+	defer p.Unlock()
+	p.written = nil
+}
+
+func (p *pipelineStats) frameDisplayed() {
+	p.Lock()
+	defer p.Unlock()
+	p.displayed++
+}
+
+func (p *pipelineStats) pliSent() {
+	p.Lock()
+	defer p.Unlock()
+	p.plis++
+}
+
+func (p *pipelineStats) nackSent(n int) {
+	p.Lock()
+	defer p.Unlock()
+	p.nacks += uint64(n)
+}
+
+//=================================================================================
@@ -0,0 +1,130 @@
+//=================================================================================
+//	Filaname: stats_test.go
+// 	Function: tests of the statistics of the stream received
+// 	Author: Stoney Kang, sikang@teamgrit.kr
+// 	Copyright: TeamGRIT, 2021
+//=================================================================================
+package main
+
+import (
+	"math"
+	"testing"
+
+	"github.com/pion/rtp"
+)
+
+//---------------------------------------------------------------------------------
+func TestReceiveStatsLoss(t *testing.T) {
+	tests := []struct {
+		name     string
+		ssrcs    []uint32 // ssrc of each packet, 1 if none
+		seqs     []uint16
+		loss     int64
+		lost     uint32 // total lost of the report
+		fraction uint8
+		lastSeq  uint32 // extended highest sequence number
+	}{
+		{name: "in order", seqs: []uint16{1, 2, 3, 4, 5}, lastSeq: 5},
+		{name: "reordered", seqs: []uint16{1, 3, 2, 4}, lastSeq: 4},
+		{name: "lost", seqs: []uint16{1, 2, 5}, loss: 2, lost: 2, fraction: 2 * 256 / 5, lastSeq: 5},
+		{name: "duplicate", seqs: []uint16{1, 2, 2, 3}, loss: -1, lastSeq: 3},
+		{name: "late before base", seqs: []uint16{10, 11, 9}, loss: -1, lastSeq: 11},
+		{name: "wrapped", seqs: []uint16{65534, 65535, 0, 1}, lastSeq: 1<<16 + 1},
+		{name: "wrapped and lost", seqs: []uint16{65535, 1}, loss: 1, lost: 1, fraction: 256 / 3, lastSeq: 1<<16 + 1},
+		{name: "new ssrc", ssrcs: []uint32{1, 1, 1, 2, 2}, seqs: []uint16{1, 5, 9, 100, 101}, lastSeq: 101},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &receiveStats{}
+			for i, seq := range tt.seqs {
+				ssrc := uint32(1)
+				if tt.ssrcs != nil {
+					ssrc = tt.ssrcs[i]
+				}
+				s.add(&rtp.Packet{Header: rtp.Header{SSRC: ssrc, SequenceNumber: seq}}, videoClockRate)
+			}
+
+			if loss := s.Loss(); loss != tt.loss {
+				t.Errorf("Loss = %d, want %d", loss, tt.loss)
+			}
+			r, ok := s.receptionReport()
+			if !ok {
+				t.Fatal("no reception report")
+			}
+			if r.TotalLost != tt.lost || r.FractionLost != tt.fraction || r.LastSequenceNumber != tt.lastSeq {
+				t.Errorf("report lost %d, fraction %d, last %d, want %d, %d, %d",
+					r.TotalLost, r.FractionLost, r.LastSequenceNumber, tt.lost, tt.fraction, tt.lastSeq)
+			}
+		})
+	}
+}
+
+// TestReceiveStatsFraction checks the fraction lost is of the interval since the last report
+func TestReceiveStatsFraction(t *testing.T) {
+	s := &receiveStats{}
+	add := func(seqs ...uint16) {
+		for _, seq := range seqs {
+			s.add(&rtp.Packet{Header: rtp.Header{SSRC: 1, SequenceNumber: seq}}, videoClockRate)
+		}
+	}
+
+	tests := []struct {
+		seqs     []uint16
+		lost     uint32
+		fraction uint8
+	}{
+		{[]uint16{1, 2, 4}, 1, 256 / 4},
+		{[]uint16{5, 6, 7, 8}, 1, 0},
+		{[]uint16{10, 11, 12, 16}, 5, 4 * 256 / 8},
+		{[]uint16{3}, 4, 0}, // a late packet recovered
+	}
+
+	for i, tt := range tests {
+		add(tt.seqs...)
+		r, _ := s.receptionReport()
+		if r.TotalLost != tt.lost || r.FractionLost != tt.fraction {
+			t.Errorf("report %d lost %d, fraction %d, want %d, %d", i, r.TotalLost, r.FractionLost, tt.lost, tt.fraction)
+		}
+	}
+}
+
+// TestReceiveStatsJitter checks the jitter of RFC 3550 6.4.1 with the packets arrived
+// at once, so the difference of transit is the one of the rtp timestamps
+func TestReceiveStatsJitter(t *testing.T) {
+	tests := []struct {
+		name string
+		ts   []uint32
+	}{
+		{"constant", []uint32{0, 0, 0, 0}},
+		{"one step", []uint32{0, 90000}},
+		{"steps", []uint32{0, 90000, 180000, 270000}},
+		{"back and forth", []uint32{90000, 0, 90000, 0, 90000}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := 0.0
+			for i := 1; i < len(tt.ts); i++ {
+				d := math.Abs(float64(int64(tt.ts[i]) - int64(tt.ts[i-1])))
+				want += (d - want) / 16
+			}
+
+			s := &receiveStats{}
+			for i, ts := range tt.ts {
+				s.add(&rtp.Packet{Header: rtp.Header{SSRC: 1, SequenceNumber: uint16(i), Timestamp: ts}}, videoClockRate)
+			}
+			r, _ := s.receptionReport()
+
+			// the packets take some time to add, 10 msec at most
+			if got := float64(r.Jitter); math.Abs(got-want) > videoClockRate/100 {
+				t.Errorf("jitter = %v, want %v", got, want)
+			}
+			if got, want := s.Jitter().Seconds(), want/videoClockRate; math.Abs(got-want) > 0.01 {
+				t.Errorf("Jitter = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+//=================================================================================
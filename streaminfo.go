@@ -0,0 +1,366 @@
+//=================================================================================
+//	Filaname: streaminfo.go
+// 	Function: detection of native video size from the received stream
+// 	Author: Stoney Kang, sikang@teamgrit.kr
+// 	Copyright: TeamGRIT, 2021
+//=================================================================================
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v2"
+)
+
+//---------------------------------------------------------------------------------
+// StreamInfo is the native format of the received video
+type StreamInfo struct {
+	Codec  string `json:"codec"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+var errShortBits = errors.New("not enough bits")
+
+// maxVideoSize limits the width and height read from a stream, not to allocate
+// the frames of a corrupt header
+const maxVideoSize = 8192
+
+func checkVideoSize(width, height int) error {
+	if width <= 0 || height <= 0 || width > maxVideoSize || height > maxVideoSize {
+		return fmt.Errorf("invalid video size: %dx%d", width, height)
+	}
+	return nil
+}
+
+//---------------------------------------------------------------------------------
+// probeVideoSize finds the native size in a packet carrying stream headers,
+// SPS of H.264, key frame of VP8, scalability structure of VP9 or sequence header of AV1
+func probeVideoSize(mime string, payload []byte) (width, height int, ok bool) {
+	defer func() {
+		if ok && checkVideoSize(width, height) != nil {
+			width, height, ok = 0, 0, false
+		}
+	}()
+
+	vc, err := lookupVideoCodec(mime)
+	if err != nil || len(payload) == 0 {
+		return
+	}
+
+	switch vc.name {
+	case webrtc.H264:
+		for _, nal := range h264NALUnits(payload) {
+			if nal[0]&0x1F == 7 {
+				width, height, err = parseH264SPS(nal)
+				return width, height, err == nil
+			}
+		}
+	case webrtc.VP8:
+		p := codecs.VP8Packet{}
+		if _, err := p.Unmarshal(payload); err != nil || p.S != 1 || p.PID != 0 {
+			return
+		}
+		// key frame: 3 bytes tag, 3 bytes start code, 14 bits width and height
+		b := p.Payload
+		if len(b) < 10 || b[0]&0x01 != 0 || b[3] != 0x9d || b[4] != 0x01 || b[5] != 0x2a {
+			return
+		}
+		width = int(binary.LittleEndian.Uint16(b[6:]) & 0x3FFF)
+		height = int(binary.LittleEndian.Uint16(b[8:]) & 0x3FFF)
+		return width, height, true
+	case webrtc.VP9:
+		p := codecs.VP9Packet{}
+		if _, err := p.Unmarshal(payload); err != nil || !p.V || !p.Y || len(p.Width) == 0 {
+			return
+		}
+		// the highest spatial layer is displayed
+		n := len(p.Width) - 1
+		return int(p.Width[n]), int(p.Height[n]), true
+	case AV1:
+		for _, obu := range av1OBUElements(payload) {
+			if (obu[0]>>3)&0x0F == av1ObuSequenceHeader {
+				width, height, err = parseAV1SequenceHeader(obu)
+				return width, height, err == nil
+			}
+		}
+	}
+	return
+}
+
+//---------------------------------------------------------------------------------
+// h264NALUnits returns the NAL units of a single NAL or STAP-A packet
+func h264NALUnits(payload []byte) (nals [][]byte) {
+	const typeSTAPA = 24
+
+	if payload[0]&0x1F != typeSTAPA {
+		return [][]byte{payload}
+	}
+	for b := payload[1:]; len(b) > 2; {
+		size := int(binary.BigEndian.Uint16(b))
+		if size == 0 || size > len(b)-2 {
+			break
+		}
+		nals = append(nals, b[2:2+size])
+		b = b[2+size:]
+	}
+	return
+}
+
+// parseH264SPS returns the cropped frame size of a sequence parameter set
+func parseH264SPS(nal []byte) (width, height int, err error) {
+	r := newBitReader(unescapeRBSP(nal[1:]))
+
+	profile := r.bits(8)
+	r.bits(16) // constraint flags, level
+	r.ue()     // seq_parameter_set_id
+
+	chromaFormat := 1
+	switch profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chromaFormat = r.ue()
+		if chromaFormat == 3 {
+			r.bits(1) // separate_colour_plane_flag
+		}
+		r.ue()              // bit_depth_luma_minus8
+		r.ue()              // bit_depth_chroma_minus8
+		r.bits(1)           // qpprime_y_zero_transform_bypass_flag
+		if r.bits(1) == 1 { // seq_scaling_matrix_present_flag
+			n := 8
+			if chromaFormat == 3 {
+				n = 12
+			}
+			for i := 0; i < n; i++ {
+				if r.bits(1) == 1 {
+					size := 16
+					if i >= 6 {
+						size = 64
+					}
+					r.skipScalingList(size)
+				}
+			}
+		}
+	}
+
+	r.ue()          // log2_max_frame_num_minus4
+	switch r.ue() { // pic_order_cnt_type
+	case 0:
+		r.ue() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		r.bits(1) // delta_pic_order_always_zero_flag
+		r.se()    // offset_for_non_ref_pic
+		r.se()    // offset_for_top_to_bottom_field
+		for n := r.ue(); n > 0 && r.err == nil; n-- {
+			r.se() // offset_for_ref_frame
+		}
+	}
+	r.ue()    // max_num_ref_frames
+	r.bits(1) // gaps_in_frame_num_value_allowed_flag
+
+	widthInMbs := r.ue() + 1
+	heightInMapUnits := r.ue() + 1
+	frameMbsOnly := r.bits(1)
+	if frameMbsOnly == 0 {
+		r.bits(1) // mb_adaptive_frame_field_flag
+	}
+	r.bits(1) // direct_8x8_inference_flag
+
+	width = widthInMbs * 16
+	height = (2 - frameMbsOnly) * heightInMapUnits * 16
+
+	if r.bits(1) == 1 { // frame_cropping_flag
+		left, right, top, bottom := r.ue(), r.ue(), r.ue(), r.ue()
+		cropX, cropY := 1, 2-frameMbsOnly
+		if chromaFormat == 1 || chromaFormat == 2 {
+			cropX = 2
+		}
+		if chromaFormat == 1 {
+			cropY *= 2
+		}
+		width -= (left + right) * cropX
+		height -= (top + bottom) * cropY
+	}
+
+	if r.err == nil {
+		r.err = checkVideoSize(width, height)
+	}
+	return width, height, r.err
+}
+
+// unescapeRBSP removes the emulation prevention bytes
+func unescapeRBSP(b []byte) []byte {
+	out := make([]byte, 0, len(b))
+	zeros := 0
+	for _, c := range b {
+		if zeros >= 2 && c == 0x03 {
+			zeros = 0
+			continue
+		}
+		if c == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+//---------------------------------------------------------------------------------
+const av1ObuSequenceHeader = 1
+
+// av1OBUElements returns the complete OBUs of an AV1 aggregation packet
+func av1OBUElements(payload []byte) (obus [][]byte) {
+	header := payload[0]
+	payload = payload[1:]
+	count := int(header&av1MaskW) >> 4
+
+	for n := 1; len(payload) > 0; n++ {
+		size := len(payload)
+		if count == 0 || n < count {
+			v, l := readLEB128(payload)
+			if l == 0 || int(v) > len(payload)-l {
+				return
+			}
+			size, payload = int(v), payload[l:]
+		}
+		first := n == 1 && header&av1FlagZ != 0
+		last := len(payload) == size && header&av1FlagY != 0
+		if size > 0 && !first && !last {
+			obus = append(obus, payload[:size])
+		}
+		payload = payload[size:]
+	}
+	return
+}
+
+// parseAV1SequenceHeader returns the max frame size of a sequence header OBU
+func parseAV1SequenceHeader(obu []byte) (width, height int, err error) {
+	hsize := 1
+	if obu[0]&0x04 != 0 {
+		hsize = 2
+	}
+	if len(obu) <= hsize {
+		return 0, 0, errShortBits
+	}
+	b := obu[hsize:]
+	if obu[0]&0x02 != 0 { // skip size field
+		_, l := readLEB128(b)
+		b = b[l:]
+	}
+	r := newBitReader(b)
+
+	r.bits(3)           // seq_profile
+	r.bits(1)           // still_picture
+	if r.bits(1) == 1 { // reduced_still_picture_header
+		r.bits(5) // seq_level_idx
+	} else {
+		decoderModelInfo, bufferDelayLength := 0, 0
+		if r.bits(1) == 1 { // timing_info_present_flag
+			r.bits(32)          // num_units_in_display_tick
+			r.bits(32)          // time_scale
+			if r.bits(1) == 1 { // equal_picture_interval
+				r.uvlc() // num_ticks_per_picture_minus_1
+			}
+			decoderModelInfo = r.bits(1)
+			if decoderModelInfo == 1 {
+				bufferDelayLength = r.bits(5) + 1
+				r.bits(32) // num_units_in_decoding_tick
+				r.bits(5)  // buffer_removal_time_length_minus_1
+				r.bits(5)  // frame_presentation_time_length_minus_1
+			}
+		}
+		initialDisplayDelay := r.bits(1)
+		for n := r.bits(5) + 1; n > 0 && r.err == nil; n-- {
+			r.bits(12) // operating_point_idc
+			if r.bits(5) > 7 {
+				r.bits(1) // seq_tier
+			}
+			if decoderModelInfo == 1 && r.bits(1) == 1 {
+				r.bits(bufferDelayLength) // decoder_buffer_delay
+				r.bits(bufferDelayLength) // encoder_buffer_delay
+				r.bits(1)                 // low_delay_mode_flag
+			}
+			if initialDisplayDelay == 1 && r.bits(1) == 1 {
+				r.bits(4) // initial_display_delay_minus_1
+			}
+		}
+	}
+
+	widthBits := r.bits(4) + 1
+	heightBits := r.bits(4) + 1
+	width = r.bits(widthBits) + 1
+	height = r.bits(heightBits) + 1
+	return width, height, r.err
+}
+
+//---------------------------------------------------------------------------------
+// bitReader reads bits in msb first order, keeping the first error
+type bitReader struct {
+	b   []byte
+	pos int
+	err error
+}
+
+func newBitReader(b []byte) *bitReader {
+	return &bitReader{b: b}
+}
+
+func (r *bitReader) bits(n int) (v int) {
+	for i := 0; i < n; i++ {
+		if r.pos >= len(r.b)*8 {
+			r.err = errShortBits
+			return 0
+		}
+		v = v<<1 | int(r.b[r.pos/8]>>(7-r.pos%8))&1
+		r.pos++
+	}
+	return
+}
+
+// ue reads an unsigned exp-golomb code
+func (r *bitReader) ue() int {
+	zeros := 0
+	for r.bits(1) == 0 && r.err == nil && zeros < 32 {
+		zeros++
+	}
+	return 1<<zeros - 1 + r.bits(zeros)
+}
+
+// se reads a signed exp-golomb code
+func (r *bitReader) se() int {
+	v := r.ue()
+	if v&1 == 1 {
+		return (v + 1) / 2
+	}
+	return -v / 2
+}
+
+// uvlc reads a variable length unsigned number of AV1
+func (r *bitReader) uvlc() int {
+	zeros := 0
+	for r.bits(1) == 0 && r.err == nil && zeros < 32 {
+		zeros++
+	}
+	if zeros >= 32 {
+		return 1<<32 - 1
+	}
+	return r.bits(zeros) + 1<<zeros - 1
+}
+
+func (r *bitReader) skipScalingList(size int) {
+	last, next := 8, 8
+	for j := 0; j < size && r.err == nil; j++ {
+		if next != 0 {
+			next = (last + r.se() + 256) % 256
+		}
+		if next != 0 {
+			last = next
+		}
+	}
+}
+
+//=================================================================================
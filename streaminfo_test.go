@@ -0,0 +1,194 @@
+//=================================================================================
+//	Filaname: streaminfo_test.go
+// 	Function: tests of the detection of native video size
+// 	Author: Stoney Kang, sikang@teamgrit.kr
+// 	Copyright: TeamGRIT, 2021
+//=================================================================================
+package main
+
+import (
+	"encoding/binary"
+	"math/bits"
+	"testing"
+)
+
+//---------------------------------------------------------------------------------
+// bitWriter writes bits in msb first order, the reverse of bitReader
+type bitWriter struct {
+	b []byte
+	n int
+}
+
+func (w *bitWriter) bits(n, v int) *bitWriter {
+	for i := n - 1; i >= 0; i-- {
+		if w.n%8 == 0 {
+			w.b = append(w.b, 0)
+		}
+		if v>>i&1 == 1 {
+			w.b[len(w.b)-1] |= 0x80 >> (w.n % 8)
+		}
+		w.n++
+	}
+	return w
+}
+
+// ue writes an unsigned exp-golomb code
+func (w *bitWriter) ue(v int) *bitWriter {
+	n := bits.Len(uint(v + 1))
+	return w.bits(n-1, 0).bits(n, v+1)
+}
+
+// escapeRBSP inserts the emulation prevention bytes, the reverse of unescapeRBSP
+func escapeRBSP(b []byte) (out []byte) {
+	zeros := 0
+	for _, c := range b {
+		if zeros >= 2 && c <= 3 {
+			out = append(out, 0x03)
+			zeros = 0
+		}
+		if c == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, c)
+	}
+	return
+}
+
+// h264SPS returns the NAL unit of a sequence parameter set with the size in
+// macroblocks and the crop at the bottom, in high profile if high
+func h264SPS(high bool, id, widthInMbs, heightInMbs, cropBottom int) []byte {
+	w := &bitWriter{}
+	if high {
+		w.bits(8, 100).bits(16, 0x0028).ue(id)
+		w.ue(1).ue(0).ue(0).bits(1, 0).bits(1, 0) // 4:2:0, 8 bits, no scaling matrix
+	} else {
+		w.bits(8, 66).bits(16, 0x0000).ue(id) // constraint flags and level of zero
+	}
+	w.ue(0).ue(0).ue(0) // log2_max_frame_num, pic_order_cnt_type 0, log2_max_poc_lsb
+	w.ue(1).bits(1, 0)  // max_num_ref_frames, gaps
+	w.ue(widthInMbs - 1).ue(heightInMbs - 1)
+	w.bits(1, 1).bits(1, 1) // frame_mbs_only, direct_8x8_inference
+	if cropBottom > 0 {
+		w.bits(1, 1).ue(0).ue(0).ue(0).ue(cropBottom)
+	} else {
+		w.bits(1, 0)
+	}
+	w.bits(1, 0).bits(1, 1) // no vui, stop bit
+	return append([]byte{0x67}, escapeRBSP(w.b)...)
+}
+
+// stapA aggregates NAL units into a STAP-A payload
+func stapA(nals ...[]byte) []byte {
+	payload := []byte{24}
+	for _, nal := range nals {
+		payload = append(payload, byte(len(nal)>>8), byte(len(nal)))
+		payload = append(payload, nal...)
+	}
+	return payload
+}
+
+// av1SequenceHeader returns a sequence header OBU of the max frame size,
+// with the size field if sized
+func av1SequenceHeader(reduced, sized bool, width, height int) []byte {
+	w := &bitWriter{}
+	w.bits(3, 0) // seq_profile
+	if reduced {
+		w.bits(1, 1).bits(1, 1).bits(5, 8) // still_picture, reduced header, seq_level_idx
+	} else {
+		w.bits(1, 0).bits(1, 0)   // still_picture, reduced header
+		w.bits(1, 0).bits(1, 0)   // timing_info_present, initial_display_delay_present
+		w.bits(5, 0)              // operating_points_cnt_minus_1
+		w.bits(12, 0).bits(5, 12) // operating_point_idc, seq_level_idx over 7
+		w.bits(1, 0)              // seq_tier
+	}
+	w.bits(4, 15).bits(4, 15) // 16 bits of width and height
+	w.bits(16, width-1).bits(16, height-1)
+
+	header := byte(av1ObuSequenceHeader << 3)
+	if !sized {
+		return append([]byte{header}, w.b...)
+	}
+	obu := appendLEB128([]byte{header | 0x02}, uint64(len(w.b)))
+	return append(obu, w.b...)
+}
+
+//---------------------------------------------------------------------------------
+func TestProbeVideoSize(t *testing.T) {
+	pps := []byte{0x68, 0xce, 0x3c, 0x80}
+	vp8Key := []byte{0x10, 0x50, 0x2a, 0x00, 0x9d, 0x01, 0x2a, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint16(vp8Key[7:], 640|0x4000) // scaling in the upper bits
+	binary.LittleEndian.PutUint16(vp8Key[9:], 480)
+
+	tests := []struct {
+		name          string
+		mime          string
+		payload       []byte
+		width, height int
+		ok            bool
+	}{
+		{"h264 sps", "video/H264", h264SPS(false, 0, 80, 45, 0), 1280, 720, true},
+		{"h264 sps in stap-a", "video/H264", stapA(h264SPS(true, 0, 120, 68, 4), pps), 1920, 1080, true},
+		{"h264 sps escaped", "video/H264", h264SPS(false, 63, 40, 30, 0), 640, 480, true},
+		{"h264 without sps", "video/H264", stapA(pps), 0, 0, false},
+		{"h264 sps too large", "video/H264", h264SPS(false, 0, 1000, 45, 0), 0, 0, false},
+		{"h264 sps truncated", "video/H264", h264SPS(false, 0, 80, 45, 0)[:4], 0, 0, false},
+		{"vp8 key frame", "video/VP8", vp8Key, 640, 480, true},
+		{"vp8 too large", "video/VP8", []byte{0x10, 0x50, 0x2a, 0x00, 0x9d, 0x01, 0x2a, 0xff, 0x3f, 0xe0, 0x01}, 0, 0, false},
+		{"vp8 inter frame", "video/VP8", []byte{0x10, 0x51, 0x2a, 0x00, 0x9d, 0x01, 0x2a, 0x80, 0x02, 0xe0, 0x01}, 0, 0, false},
+		{"vp8 not partition start", "video/VP8", append([]byte{0x00}, vp8Key[1:]...), 0, 0, false},
+		{"vp9 scalability structure", "video/VP9", []byte{0x0a, 0x30, 0x01, 0x40, 0x00, 0xb4, 0x02, 0x80, 0x01, 0x68, 0x00}, 640, 360, true},
+		{"vp9 without scalability structure", "video/VP9", []byte{0x08, 0x00}, 0, 0, false},
+		{"av1 sequence header", "video/AV1", append([]byte{0x18}, av1SequenceHeader(false, false, 1920, 1080)...), 1920, 1080, true},
+		{"av1 reduced sequence header", "video/AV1", append([]byte{0x18}, av1SequenceHeader(true, true, 320, 240)...), 320, 240, true},
+		{"av1 sequence header with length", "video/AV1", append(appendLEB128([]byte{0x28}, 1), append([]byte{0x12}, av1SequenceHeader(false, false, 1280, 720)...)...), 1280, 720, true},
+		{"av1 too large", "video/AV1", append([]byte{0x18}, av1SequenceHeader(false, false, 65536, 1080)...), 0, 0, false},
+		{"av1 without sequence header", "video/AV1", []byte{0x10, 0x12, 0x00}, 0, 0, false},
+		{"unknown codec", "video/H265", []byte{0x40}, 0, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			width, height, ok := probeVideoSize(tt.mime, tt.payload)
+			if ok != tt.ok || ok && (width != tt.width || height != tt.height) {
+				t.Errorf("probeVideoSize = %d, %d, %v, want %d, %d, %v", width, height, ok, tt.width, tt.height, tt.ok)
+			}
+		})
+	}
+}
+
+func TestLEB128(t *testing.T) {
+	tests := []struct {
+		name string
+		b    []byte
+		v    uint64
+		n    int
+	}{
+		{"zero", []byte{0x00}, 0, 1},
+		{"one byte", []byte{0x7f}, 127, 1},
+		{"two bytes", []byte{0x80, 0x01}, 128, 2},
+		{"three bytes", []byte{0xe5, 0x8e, 0x26}, 624485, 3},
+		{"trailing bytes", []byte{0x05, 0xff}, 5, 1},
+		{"empty", nil, 0, 0},
+		{"unterminated", []byte{0x80, 0x80}, 0, 0},
+		{"over 8 bytes", []byte{0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x01}, 0, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, n := readLEB128(tt.b)
+			if v != tt.v || n != tt.n {
+				t.Errorf("readLEB128 = %d, %d, want %d, %d", v, n, tt.v, tt.n)
+			}
+			if n == 0 {
+				return
+			}
+			if b := appendLEB128(nil, v); string(b) != string(tt.b[:n]) {
+				t.Errorf("appendLEB128 = %x, want %x", b, tt.b[:n])
+			}
+		})
+	}
+}
+
+//=================================================================================
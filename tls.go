@@ -0,0 +1,91 @@
+//=================================================================================
+//	Filaname: tls.go
+// 	Function: tls configuration to connect the spider server
+// 	Author: Stoney Kang, sikang@teamgrit.kr
+// 	Copyright: TeamGRIT, 2021
+//=================================================================================
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+//---------------------------------------------------------------------------------
+// tlsConfig returns the tls configuration of the settings. The server certificate
+// is verified unless TLSInsecure, and must match one of TLSPins if given, even if insecure.
+func (d *Program) tlsConfig() (config *tls.Config, err error) {
+	config = &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if d.TLSCACert != "" {
+		pem, err := os.ReadFile(d.TLSCACert)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate in %s", d.TLSCACert)
+		}
+		config.RootCAs = pool
+	}
+
+	if d.TLSCert != "" || d.TLSKey != "" {
+		cert, err := tls.LoadX509KeyPair(d.TLSCert, d.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if d.TLSInsecure {
+		log.Println("warning: certificate of spider server is not verified")
+		config.InsecureSkipVerify = true
+	}
+
+	pins := splitList(d.TLSPins)
+	if len(pins) > 0 {
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifyPins(cs.PeerCertificates, pins)
+		}
+	}
+	return
+}
+
+// verifyPins checks if a certificate in the chain has one of the pins,
+// base64 encoded sha256 hashes of subject public key info
+func verifyPins(certs []*x509.Certificate, pins []string) error {
+	for _, cert := range certs {
+		sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		hash := base64.StdEncoding.EncodeToString(sum[:])
+		for _, pin := range pins {
+			if hash == strings.TrimPrefix(pin, "sha256/") {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("certificate of spider server does not match the pins")
+}
+
+// splitList returns the trimmed items of a comma separated list
+func splitList(s string) (items []string) {
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return
+}
+
+//=================================================================================
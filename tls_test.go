@@ -0,0 +1,115 @@
+//=================================================================================
+//	Filaname: tls_test.go
+// 	Function: tests of the pinning of the spider server certificate
+// 	Author: Stoney Kang, sikang@teamgrit.kr
+// 	Copyright: TeamGRIT, 2021
+//=================================================================================
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+//---------------------------------------------------------------------------------
+// newCert generates a self-signed certificate and its pin
+func newCert(t *testing.T, name string) (cert *x509.Certificate, pin string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err = x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, spkiPin(cert)
+}
+
+func spkiPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func TestVerifyPins(t *testing.T) {
+	leaf, leafPin := newCert(t, "leaf")
+	ca, caPin := newCert(t, "ca")
+	_, otherPin := newCert(t, "other")
+
+	tests := []struct {
+		name  string
+		certs []*x509.Certificate
+		pins  []string
+		ok    bool
+	}{
+		{"leaf", []*x509.Certificate{leaf, ca}, []string{leafPin}, true},
+		{"ca in chain", []*x509.Certificate{leaf, ca}, []string{caPin}, true},
+		{"one of pins", []*x509.Certificate{leaf}, []string{otherPin, leafPin}, true},
+		{"sha256 prefix", []*x509.Certificate{leaf}, []string{"sha256/" + leafPin}, true},
+		{"other", []*x509.Certificate{leaf, ca}, []string{otherPin}, false},
+		{"no certificate", nil, []string{leafPin}, false},
+		{"hex not base64", []*x509.Certificate{leaf}, []string{"0123abcd"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := verifyPins(tt.certs, tt.pins); (err == nil) != tt.ok {
+				t.Errorf("verifyPins = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestTLSConfigPins(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	_, otherPin := newCert(t, "other")
+
+	tests := []struct {
+		name string
+		pins string
+		ok   bool
+	}{
+		{"match", otherPin + "," + spkiPin(server.Certificate()), true},
+		{"reject", otherPin, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &Program{TLSInsecure: true, TLSPins: tt.pins} // self-signed, checked by pins only
+			config, err := d.tlsConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+			resp, err := client.Get(server.URL)
+			if err == nil {
+				resp.Body.Close()
+			}
+			if (err == nil) != tt.ok {
+				t.Errorf("get = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+//=================================================================================
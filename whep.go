@@ -0,0 +1,268 @@
+//=================================================================================
+//	Filaname: whep.go
+// 	Function: signaling by webrtc-http egress protocol (whep)
+// 	Author: Stoney Kang, sikang@teamgrit.kr
+// 	Copyright: TeamGRIT, 2021
+//=================================================================================
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sikang99/spider-view/signaling"
+)
+
+//---------------------------------------------------------------------------------
+const (
+	whepTimeout  = 10 * time.Second
+	whepSDPType  = "application/sdp"
+	whepFragType = "application/trickle-ice-sdpfrag"
+)
+
+// whepSignaler posts the offer to a whep endpoint and gets the answer.
+// Candidates are trickled by PATCH to the session resource, deleted on close.
+type whepSignaler struct {
+	d         *Program
+	url       string
+	client    *http.Client
+	recv      chan signaling.Message
+	mu        sync.Mutex
+	location  string   // url of the session resource
+	etag      string   // entity tag of the session resource
+	offer     string   // sdp of the offer, for ice credentials of candidates
+	pending   []string // candidates before the session resource is created
+	noTrickle bool     // server does not support trickle by PATCH
+}
+
+func (s *whepSignaler) Open() (err error) {
+	tlsConfig, err := s.d.tlsConfig()
+	if err != nil {
+		return
+	}
+	s.client = &http.Client{
+		Timeout: whepTimeout,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		},
+	}
+	s.recv = make(chan signaling.Message, 2)
+	return
+}
+
+func (s *whepSignaler) Send(m signaling.Message) (err error) {
+	switch m := m.(type) {
+	case signaling.Offer:
+		return s.postOffer(m.SDP)
+	case signaling.Candidate:
+		return s.patchCandidates(m.Candidate)
+	default:
+		log.Println("whep: ignore", m.Type())
+	}
+	return
+}
+
+func (s *whepSignaler) Recv() <-chan signaling.Message {
+	return s.recv
+}
+
+func (s *whepSignaler) Trickle() bool {
+	return true
+}
+
+// Close deletes the session resource on the server
+func (s *whepSignaler) Close() (err error) {
+	s.mu.Lock()
+	location := s.location
+	s.location = ""
+	s.mu.Unlock()
+	if location == "" {
+		return
+	}
+
+	resp, err := s.do(http.MethodDelete, location, "", "", nil)
+	if err != nil {
+		log.Println("whep delete:", err)
+		return
+	}
+	defer resp.Body.Close()
+	if err = whepError(resp, http.StatusOK, http.StatusNoContent); err != nil {
+		log.Println("whep delete:", err)
+	}
+	return
+}
+
+//---------------------------------------------------------------------------------
+// postOffer creates the session by the offer and passes the answer to Recv
+func (s *whepSignaler) postOffer(sdp string) (err error) {
+	log.Println("i.postOffer:", s.url)
+
+	s.mu.Lock()
+	s.offer = sdp
+	s.mu.Unlock()
+
+	resp, err := s.do(http.MethodPost, s.url, whepSDPType, sdp, nil)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	err = whepError(resp, http.StatusCreated)
+	if err != nil {
+		return
+	}
+	if ctype, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); ctype != whepSDPType {
+		return fmt.Errorf("whep post: unexpected content type %q", ctype)
+	}
+	loc := resp.Header.Get("Location")
+	if loc == "" {
+		return fmt.Errorf("whep post: no location of the session")
+	}
+	// relative to the url after redirects
+	u, err := resp.Request.URL.Parse(loc)
+	if err != nil {
+		return
+	}
+
+	answer, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.location = u.String()
+	s.etag = resp.Header.Get("ETag")
+	pending := s.pending
+	s.pending = nil
+	s.mu.Unlock()
+	log.Println("whep session:", u)
+
+	s.recv <- signaling.Answer{SDP: string(answer)}
+
+	if len(pending) > 0 {
+		err = s.patchCandidates(pending...)
+	}
+	return
+}
+
+// patchCandidates sends candidates to the session resource, or keeps them
+// until the resource is created
+func (s *whepSignaler) patchCandidates(candidates ...string) (err error) {
+	s.mu.Lock()
+	if s.noTrickle {
+		s.mu.Unlock()
+		return
+	}
+	if s.location == "" {
+		s.pending = append(s.pending, candidates...)
+		s.mu.Unlock()
+		return
+	}
+	location, etag := s.location, s.etag
+	frag := sdpFragment(s.offer, candidates)
+	s.mu.Unlock()
+
+	header := http.Header{}
+	if etag != "" {
+		header.Set("If-Match", etag)
+	}
+	resp, err := s.do(http.MethodPatch, location, whepFragType, frag, header)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusMethodNotAllowed, http.StatusNotImplemented, http.StatusUnsupportedMediaType:
+		// candidates in the answer are enough for the server
+		log.Println("whep: no trickle by server,", resp.Status)
+		s.mu.Lock()
+		s.noTrickle = true
+		s.mu.Unlock()
+		return nil
+	}
+	return whepError(resp, http.StatusNoContent, http.StatusOK)
+}
+
+// do sends a request to the whep server with the auth header
+func (s *whepSignaler) do(method, url, ctype, body string, header http.Header) (resp *http.Response, err error) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		return
+	}
+	auth, err := s.d.authHeader()
+	if err != nil {
+		return
+	}
+	for k, v := range auth {
+		req.Header[k] = v
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if ctype != "" {
+		req.Header.Set("Content-Type", ctype)
+	}
+	return s.client.Do(req)
+}
+
+//---------------------------------------------------------------------------------
+// whepError returns an error if the status is not one of expected.
+// A rejected request by auth is AuthError to stop reconnecting.
+func whepError(resp *http.Response, expected ...int) error {
+	for _, code := range expected {
+		if resp.StatusCode == code {
+			return nil
+		}
+	}
+	if aerr := authError(resp); aerr != nil {
+		return aerr
+	}
+
+	body, _ := ioutil.ReadAll(&io.LimitedReader{R: resp.Body, N: 512})
+	msg := strings.TrimSpace(string(body))
+	if ra := resp.Header.Get("Retry-After"); ra != "" {
+		msg += " (retry after " + ra + ")"
+	}
+	return fmt.Errorf("whep %s %s: %s %s", resp.Request.Method, resp.Request.URL, resp.Status, msg)
+}
+
+// sdpFragment makes the sdp fragment of trickle ice with the ice credentials
+// and the first media of the offer, as all media are bundled
+func sdpFragment(offer string, candidates []string) string {
+	var ufrag, pwd, media, mid string
+	for _, line := range strings.Split(offer, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "a=ice-ufrag:") && ufrag == "":
+			ufrag = line
+		case strings.HasPrefix(line, "a=ice-pwd:") && pwd == "":
+			pwd = line
+		case strings.HasPrefix(line, "m=") && media == "":
+			media = line
+		case strings.HasPrefix(line, "a=mid:") && mid == "":
+			mid = line
+		}
+	}
+
+	var b strings.Builder
+	for _, line := range []string{ufrag, pwd, media, mid} {
+		if line != "" {
+			b.WriteString(line + "\r\n")
+		}
+	}
+	for _, c := range candidates {
+		b.WriteString("a=" + strings.TrimPrefix(c, "a=") + "\r\n")
+	}
+	return b.String()
+}
+
+//=================================================================================
@@ -0,0 +1,154 @@
+//=================================================================================
+//	Filaname: whep_test.go
+// 	Function: tests of signaling by whep
+// 	Author: Stoney Kang, sikang@teamgrit.kr
+// 	Copyright: TeamGRIT, 2021
+//=================================================================================
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+//---------------------------------------------------------------------------------
+func TestWHEPError(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		retryAfter string
+		body       string
+		auth       bool   // AuthError
+		msg        string // in the error, empty if no error
+	}{
+		{"expected", http.StatusCreated, "", "", false, ""},
+		{"other expected", http.StatusNoContent, "", "", false, ""},
+		{"unauthorized", http.StatusUnauthorized, "", "bad token", true, "401 Unauthorized: bad token"},
+		{"forbidden", http.StatusForbidden, "", "", true, "403 Forbidden"},
+		{"not found", http.StatusNotFound, "", "no stream\n", false, "whep POST http://host/whep: 404 Not Found no stream"},
+		{"busy", http.StatusServiceUnavailable, "5", "busy", false, "503 Service Unavailable busy (retry after 5)"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodPost, "http://host/whep", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp := &http.Response{
+				StatusCode: tt.status,
+				Status:     fmt.Sprintf("%d %s", tt.status, http.StatusText(tt.status)),
+				Header:     http.Header{},
+				Body:       io.NopCloser(strings.NewReader(tt.body)),
+				Request:    req,
+			}
+			if tt.retryAfter != "" {
+				resp.Header.Set("Retry-After", tt.retryAfter)
+			}
+
+			err = whepError(resp, http.StatusCreated, http.StatusNoContent)
+			if tt.msg == "" {
+				if err != nil {
+					t.Errorf("whepError = %v, want nil", err)
+				}
+				return
+			}
+			var aerr *AuthError
+			if err == nil || errors.As(err, &aerr) != tt.auth || !strings.Contains(err.Error(), tt.msg) {
+				t.Errorf("whepError = %v, want %q auth %v", err, tt.msg, tt.auth)
+			}
+		})
+	}
+}
+
+func TestSDPFragment(t *testing.T) {
+	offer := "v=0\r\n" +
+		"m=audio 9 UDP/TLS/RTP/SAVPF 111\r\n" +
+		"a=ice-ufrag:abcd\r\n" +
+		"a=ice-pwd:secret\r\n" +
+		"a=mid:0\r\n" +
+		"m=video 9 UDP/TLS/RTP/SAVPF 96\r\n" +
+		"a=ice-ufrag:other\r\n" +
+		"a=mid:1\r\n"
+
+	tests := []struct {
+		name       string
+		offer      string
+		candidates []string
+		frag       string
+	}{
+		{"first media", offer, []string{"candidate:1 1 udp 2130706431 192.0.2.1 5000 typ host"},
+			"a=ice-ufrag:abcd\r\na=ice-pwd:secret\r\nm=audio 9 UDP/TLS/RTP/SAVPF 111\r\na=mid:0\r\n" +
+				"a=candidate:1 1 udp 2130706431 192.0.2.1 5000 typ host\r\n"},
+		{"prefixed candidates", offer, []string{"a=candidate:1", "candidate:2"},
+			"a=ice-ufrag:abcd\r\na=ice-pwd:secret\r\nm=audio 9 UDP/TLS/RTP/SAVPF 111\r\na=mid:0\r\n" +
+				"a=candidate:1\r\na=candidate:2\r\n"},
+		{"lf only", strings.ReplaceAll(offer, "\r\n", "\n"), nil,
+			"a=ice-ufrag:abcd\r\na=ice-pwd:secret\r\nm=audio 9 UDP/TLS/RTP/SAVPF 111\r\na=mid:0\r\n"},
+		{"no offer", "", []string{"candidate:1"}, "a=candidate:1\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if frag := sdpFragment(tt.offer, tt.candidates); frag != tt.frag {
+				t.Errorf("sdpFragment = %q, want %q", frag, tt.frag)
+			}
+		})
+	}
+}
+
+func TestWHEPLocation(t *testing.T) {
+	var location string // of the session, given by the test
+	mux := http.NewServeMux()
+	mux.HandleFunc("/old/whep", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/live/whep", http.StatusTemporaryRedirect)
+	})
+	mux.HandleFunc("/live/whep", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", whepSDPType)
+		if location != "" {
+			w.Header().Set("Location", location)
+		}
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, "v=0\r\n")
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		path     string
+		location string
+		want     string // session url, empty if an error
+	}{
+		{"absolute path", "/live/whep", "/res/1", server.URL + "/res/1"},
+		{"relative path", "/live/whep", "res/1", server.URL + "/live/res/1"},
+		{"absolute url", "/live/whep", "http://other.example.com/res/1", "http://other.example.com/res/1"},
+		{"after redirect", "/old/whep", "res/1", server.URL + "/live/res/1"},
+		{"no location", "/live/whep", "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			location = tt.location
+			s := &whepSignaler{d: &Program{}, url: server.URL + tt.path}
+			if err := s.Open(); err != nil {
+				t.Fatal(err)
+			}
+
+			err := s.postOffer("v=0\r\n")
+			if (err == nil) != (tt.want != "") {
+				t.Fatalf("postOffer = %v, want ok %v", err, tt.want != "")
+			}
+			if s.location != tt.want {
+				t.Errorf("location %s, want %s", s.location, tt.want)
+			}
+		})
+	}
+}
+
+//=================================================================================
@@ -0,0 +1,179 @@
+//=================================================================================
+//	Filaname: zone.go
+// 	Function: polygonal zones to include or exclude in motion detection
+// 	Author: Stoney Kang, sikang@teamgrit.kr
+// 	Copyright: TeamGRIT, 2021
+//=================================================================================
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+
+	"gocv.io/x/gocv"
+)
+
+//---------------------------------------------------------------------------------
+// ZoneDefault is the key of zones for the channels without their own
+const ZoneDefault = "*"
+
+// Zone is a polygon of the frame where motion is detected, or ignored if excluded.
+// Points are relative to the size of the frame, from 0 to 1, not to depend on the scale.
+type Zone struct {
+	Name    string       `json:"name"`
+	Exclude bool         `json:"exclude,omitempty"`
+	Points  [][2]float64 `json:"points"`
+}
+
+// ZoneMotion is the motion status of an include zone
+type ZoneMotion struct {
+	Name     string  `json:"name"`
+	Detected bool    `json:"detected"`
+	Area     float64 `json:"area"`
+}
+
+// checkZones tells whether the zones of all channels are valid polygons
+func checkZones(zones map[string][]Zone) (err error) {
+	for channel, list := range zones {
+		for i, z := range list {
+			if len(z.Points) < 3 {
+				return fmt.Errorf("zone %d of %s: %d points, at least 3", i, channel, len(z.Points))
+			}
+			for _, p := range z.Points {
+				if p[0] < 0 || p[0] > 1 || p[1] < 0 || p[1] > 1 {
+					return fmt.Errorf("zone %d of %s: point %v out of 0 to 1", i, channel, p)
+				}
+			}
+		}
+	}
+	return
+}
+
+// channelZones returns the zones of the channel, or the default ones
+func (d *Program) channelZones(channel string) []Zone {
+	if zones, ok := d.Zones[channel]; ok {
+		return zones
+	}
+	return d.Zones[ZoneDefault]
+}
+
+//---------------------------------------------------------------------------------
+// zoneMask is the mask of the foreground by the zones, made again at a new frame size
+type zoneMask struct {
+	zones []Zone
+	size  image.Point
+	polys [][]image.Point // zones in pixels of the frame
+	mask  gocv.Mat
+}
+
+func newZoneMask(zones []Zone) *zoneMask {
+	return &zoneMask{zones: zones, mask: gocv.NewMat()}
+}
+
+func (z *zoneMask) setZones(zones []Zone) {
+	z.zones = zones
+	z.size = image.Point{} // to make the mask again
+}
+
+// apply clears the foreground out of the zones
+func (z *zoneMask) apply(fg *gocv.Mat) {
+	if len(z.zones) == 0 {
+		return
+	}
+	size := image.Pt(fg.Cols(), fg.Rows())
+	if size != z.size {
+		z.build(size)
+	}
+	gocv.BitwiseAnd(*fg, z.mask, fg)
+}
+
+// build makes the mask of the union of include zones, or the whole frame if none,
+// minus the union of exclude zones
+func (z *zoneMask) build(size image.Point) {
+	z.size = size
+	z.polys = nil
+	for _, zone := range z.zones {
+		poly := []image.Point{}
+		for _, p := range zone.Points {
+			poly = append(poly, image.Pt(int(p[0]*float64(size.X)), int(p[1]*float64(size.Y))))
+		}
+		z.polys = append(z.polys, poly)
+	}
+
+	include, exclude := [][]image.Point{}, [][]image.Point{}
+	for i, zone := range z.zones {
+		if zone.Exclude {
+			exclude = append(exclude, z.polys[i])
+		} else {
+			include = append(include, z.polys[i])
+		}
+	}
+
+	z.mask.Close()
+	background := 255.0
+	if len(include) > 0 {
+		background = 0
+	}
+	z.mask = gocv.NewMatWithSizeFromScalar(gocv.NewScalar(background, 0, 0, 0), size.Y, size.X, gocv.MatTypeCV8U)
+	fillPolys(&z.mask, include, color.RGBA{255, 255, 255, 0})
+	fillPolys(&z.mask, exclude, color.RGBA{0, 0, 0, 0})
+}
+
+// status returns the motion of include zones by the centers of the boxes
+func (z *zoneMask) status(boxes []image.Rectangle, areas []float64) (zones []ZoneMotion) {
+	for i, zone := range z.zones {
+		if zone.Exclude {
+			continue
+		}
+		m := ZoneMotion{Name: zone.Name}
+		pv := gocv.NewPointVectorFromPoints(z.polys[i])
+		for j, box := range boxes {
+			center := box.Min.Add(box.Max).Div(2)
+			if gocv.PointPolygonTest(pv, center, false) >= 0 {
+				m.Detected = true
+				m.Area += areas[j]
+			}
+		}
+		pv.Close()
+		zones = append(zones, m)
+	}
+	return
+}
+
+// draw shows the zones on the frame, include zones in red at motion
+func (z *zoneMask) draw(img *gocv.Mat, zones []ZoneMotion) {
+	k := 0 // index of include zones in the status
+	for i, zone := range z.zones {
+		c := color.RGBA{255, 255, 0, 0}
+		if zone.Exclude {
+			c = color.RGBA{128, 128, 128, 0}
+		} else {
+			if k < len(zones) && zones[k].Detected {
+				c = color.RGBA{255, 0, 0, 0}
+			}
+			k++
+		}
+		pvs := gocv.NewPointsVectorFromPoints([][]image.Point{z.polys[i]})
+		gocv.Polylines(img, pvs, true, c, 1)
+		pvs.Close()
+		if zone.Name != "" {
+			gocv.PutText(img, zone.Name, z.polys[i][0].Add(image.Pt(4, 14)), gocv.FontHersheyPlain, 1.0, c, 1)
+		}
+	}
+}
+
+func (z *zoneMask) Close() {
+	z.mask.Close()
+}
+
+func fillPolys(img *gocv.Mat, polys [][]image.Point, c color.RGBA) {
+	if len(polys) == 0 {
+		return
+	}
+	pvs := gocv.NewPointsVectorFromPoints(polys)
+	defer pvs.Close()
+	gocv.FillPoly(img, pvs, c)
+}
+
+//=================================================================================
@@ -0,0 +1,50 @@
+//=================================================================================
+//	Filaname: zone_test.go
+// 	Function: tests of the zones of motion detection
+// 	Author: Stoney Kang, sikang@teamgrit.kr
+// 	Copyright: TeamGRIT, 2021
+//=================================================================================
+package main
+
+import (
+	"testing"
+)
+
+//---------------------------------------------------------------------------------
+func TestCheckZones(t *testing.T) {
+	triangle := [][2]float64{{0, 0}, {1, 0}, {0.5, 1}}
+
+	tests := []struct {
+		name  string
+		zones map[string][]Zone
+		ok    bool
+	}{
+		{"none", nil, true},
+		{"triangle", map[string][]Zone{"cam1": {{Name: "door", Points: triangle}}}, true},
+		{"default and exclude", map[string][]Zone{
+			ZoneDefault: {{Name: "all", Points: [][2]float64{{0, 0}, {1, 0}, {1, 1}, {0, 1}}}},
+			"cam1":      {{Name: "tree", Exclude: true, Points: triangle}},
+		}, true},
+		{"no point", map[string][]Zone{"cam1": {{Name: "door"}}}, false},
+		{"two points", map[string][]Zone{"cam1": {{Name: "line", Points: [][2]float64{{0, 0}, {1, 1}}}}}, false},
+		{"invalid after valid", map[string][]Zone{"cam1": {
+			{Name: "door", Points: triangle},
+			{Name: "line", Points: [][2]float64{{0, 0}, {1, 1}}},
+		}}, false},
+		{"negative x", map[string][]Zone{"cam1": {{Points: [][2]float64{{-0.1, 0}, {1, 0}, {1, 1}}}}}, false},
+		{"x over 1", map[string][]Zone{"cam1": {{Points: [][2]float64{{0, 0}, {1.5, 0}, {1, 1}}}}}, false},
+		{"negative y", map[string][]Zone{"cam1": {{Points: [][2]float64{{0, 0}, {1, -1}, {1, 1}}}}}, false},
+		{"y over 1", map[string][]Zone{"cam1": {{Points: [][2]float64{{0, 0}, {1, 0}, {1, 1.01}}}}}, false},
+		{"pixels not ratio", map[string][]Zone{"cam1": {{Points: [][2]float64{{0, 0}, {640, 0}, {640, 480}}}}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkZones(tt.zones); (err == nil) != tt.ok {
+				t.Errorf("checkZones = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+//=================================================================================